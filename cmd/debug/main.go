@@ -1,13 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/docdiff"
+	"github.com/astromechza/automerge-experiments/pkg/identity"
+	"github.com/astromechza/automerge-experiments/pkg/todo"
 )
 
 func main() {
@@ -20,24 +26,25 @@ func main() {
 func mainInner() error {
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})))
 
+	signaturesVar := flag.String("signatures", "", "a json file of change signatures, as served by /stores/{store}/signatures, to verify authorship against")
 	flag.Parse()
+	if flag.Arg(0) == "conflicts" {
+		if flag.NArg() != 2 {
+			return fmt.Errorf("expected the file to read after the conflicts command")
+		}
+		doc, err := loadDoc(flag.Arg(1))
+		if err != nil {
+			return err
+		}
+		return printConflicts(doc)
+	}
 	if flag.NArg() != 1 {
 		return fmt.Errorf("expected one position argument: the file to read")
 	}
-	f, err := os.Open(flag.Arg(0))
-	if err != nil {
-		return fmt.Errorf("failed to open input file: %w", err)
-	}
-	defer f.Close()
-	buff, err := io.ReadAll(f)
-	if err != nil {
-		return fmt.Errorf("failed to read input file: %w", err)
-	}
-	doc, err := automerge.Load(buff)
+	doc, err := loadDoc(flag.Arg(0))
 	if err != nil {
-		return fmt.Errorf("failed to load doc: %w", err)
+		return err
 	}
-	buff = nil
 	slog.Info("loaded doc", "contents", doc.RootMap().GoString())
 	slog.Info("loaded heads", "heads", doc.Heads())
 
@@ -47,15 +54,42 @@ func mainInner() error {
 	if err != nil {
 		return fmt.Errorf("failed to generate changes: %w", err)
 	}
+	var signatures map[string]identity.Signature
+	if *signaturesVar != "" {
+		raw, err := os.ReadFile(*signaturesVar)
+		if err != nil {
+			return fmt.Errorf("failed to read signatures: %w", err)
+		}
+		var list []identity.Signature
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return fmt.Errorf("failed to decode signatures: %w", err)
+		}
+		signatures = make(map[string]identity.Signature, len(list))
+		for _, sig := range list {
+			signatures[sig.Hash] = sig
+		}
+	}
+
+	names := identity.Names(doc)
 	for i, change := range changes {
-		slog.Info("change", "i", fmt.Sprintf("%4d", i), "hash", change.Hash(), "actor", change.ActorID(), "dep", change.Dependencies())
+		attrs := []any{"i", fmt.Sprintf("%4d", i), "hash", change.Hash(), "actor", identity.Label(names, change.ActorID()), "dep", change.Dependencies()}
+		if signatures != nil {
+			if sig, ok := signatures[change.Hash().String()]; !ok {
+				attrs = append(attrs, "signature", "missing")
+			} else if err := sig.Verify(change, todo.Reproduced(doc)); err != nil {
+				attrs = append(attrs, "signature", "invalid", "err", err)
+			} else {
+				attrs = append(attrs, "signature", "valid")
+			}
+		}
+		slog.Info("change", attrs...)
 	}
 
 	fmt.Println(`digraph "log" {`)
 	for _, change := range changes {
 		docAt, _ := doc.Fork(change.Hash())
 		value, _ := docAt.Path("counter").Counter().Get()
-		fmt.Printf("    \"%s\" [label=\"%s %s@%d %d\"]\n", change.Hash(), change.Hash().String()[:8], change.ActorID(), change.ActorSeq(), value)
+		fmt.Printf("    \"%s\" [label=\"%s %s@%d %d\"]\n", change.Hash(), change.Hash().String()[:8], identity.Label(names, change.ActorID()), change.ActorSeq(), value)
 		for _, hash := range change.Dependencies() {
 			fmt.Printf("    \"%s\" -> \"%s\"\n", hash, change.Hash())
 		}
@@ -63,3 +97,42 @@ func mainInner() error {
 	fmt.Println("}")
 	return nil
 }
+
+func loadDoc(path string) (*automerge.Doc, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input file: %w", err)
+	}
+	defer f.Close()
+	buff, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read input file: %w", err)
+	}
+	doc, err := automerge.Load(buff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load doc: %w", err)
+	}
+	return doc, nil
+}
+
+// printConflicts lists each key with concurrent values, marking the one that the doc shows with a star.
+func printConflicts(doc *automerge.Doc) error {
+	found, err := todo.Conflicts(doc)
+	if err != nil {
+		return err
+	}
+	names := identity.Names(doc)
+	for _, c := range found {
+		fmt.Println(docdiff.PathString(c.Path))
+		for _, v := range c.Values {
+			marker := " "
+			if v.Winner {
+				marker = "*"
+			}
+			raw, _ := json.Marshal(v.Value)
+			fmt.Printf("  %s %s by %s in %s at %s\n", marker, raw, identity.Label(names, v.Actor), v.Change[:8], v.Time.Format(time.RFC3339))
+		}
+	}
+	slog.Info("found conflicts", "count", len(found))
+	return nil
+}
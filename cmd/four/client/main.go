@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,6 +14,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -21,6 +22,9 @@ import (
 	"github.com/gorilla/websocket"
 
 	"github.com/astromechza/automerge-experiments/cmd/four/pkg"
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+	"github.com/astromechza/automerge-experiments/pkg/batch"
+	"github.com/astromechza/automerge-experiments/pkg/identity"
 	"github.com/astromechza/automerge-experiments/pkg/viz"
 )
 
@@ -33,37 +37,52 @@ func main() {
 
 func mainInner() error {
 	addrVar := flag.String("addr", "127.0.0.1:8080", "the address to request on")
+	tokenVar := flag.String("token", "", "the bearer token to authenticate with, defaults to $"+auth.TokenEnvVar)
+	tokenFileVar := flag.String("token-file", "", "a file containing the bearer token to authenticate with")
+	identityVar := flag.String("identity", "", "the device key file, created if it does not exist, defaults to one in the user config dir")
+	nameVar := flag.String("name", "", "a display name for this device, recorded in the doc so that its changes can be attributed")
+	docKeyVar := flag.String("doc-key", "", "a hex encoded 32 byte document key, setting this syncs through the end-to-end encrypted relay")
+	docKeyFileVar := flag.String("doc-key-file", "", "a file containing the hex encoded document key")
+	batchWindowVar := flag.Duration("batch-window", batch.DefaultWindow, "how long to gather local edits into one commit, zero commits every edit")
+	flag.Parse()
 	baseUrl, err := url.Parse("http://" + *addrVar)
 	if err != nil {
 		return err
 	}
-
-	var doc *automerge.Doc
-
-	resp, err := http.DefaultClient.Get(baseUrl.JoinPath("stores/default/latest").String())
+	token, err := auth.ResolveToken(*tokenVar, *tokenFileVar)
 	if err != nil {
-		return fmt.Errorf("failed to get: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
-	switch resp.StatusCode {
-	case http.StatusOK:
+	if *identityVar == "" {
+		if *identityVar, err = identity.DefaultPath(); err != nil {
+			return err
+		}
+	}
+	device, err := identity.LoadOrCreate(*identityVar)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
 
-		raw, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return fmt.Errorf("failed to read body from get: %w", err)
+	var doc *automerge.Doc
+	var docKey []byte
+	if *docKeyVar != "" || *docKeyFileVar != "" {
+		// the relay cannot give us a snapshot, so we start empty and receive the full history on connect
+		if docKey, err = pkg.LoadDocKey(*docKeyVar, *docKeyFileVar); err != nil {
+			return err
 		}
-		if d, err := automerge.Load(raw); err != nil {
-			return fmt.Errorf("failed to load doc: %w", err)
-		} else {
-			doc = d
-			_ = doc.SetActorID(hex.EncodeToString([]byte(fmt.Sprintf("%d", os.Getpid()))))
+		doc = automerge.New()
+		if err := doc.SetActorID(device.ActorID()); err != nil {
+			return fmt.Errorf("failed to set actor id: %w", err)
 		}
-	default:
-		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	} else if doc, err = fetchLatest(baseUrl, token, device); err != nil {
+		return err
 	}
 
 	slog.Info("established base doc", "heads", doc.Heads())
-	c := &client{doc: doc, baseUrl: baseUrl}
+	c := &client{doc: doc, baseUrl: baseUrl, token: token, device: device, docKey: docKey, name: *nameVar}
+	c.batch = batch.New(doc, &c.docLock)
+	c.batch.Window = *batchWindowVar
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -72,7 +91,11 @@ func mainInner() error {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		c.connectAndSyncContinuously(ctx)
+		if docKey != nil {
+			c.connectAndRelayContinuously(ctx)
+		} else {
+			c.connectAndSyncContinuously(ctx)
+		}
 	}()
 
 	wg.Add(1)
@@ -88,6 +111,9 @@ func mainInner() error {
 	cancel()
 
 	wg.Wait()
+	if err := c.batch.Flush(); err != nil {
+		return err
+	}
 
 	tf := filepath.Join(os.TempDir(), doc.ActorID()+".automerge")
 	if f, err := os.Create(tf); err != nil {
@@ -107,9 +133,47 @@ func mainInner() error {
 	return nil
 }
 
+// fetchLatest downloads the current snapshot of the store from the server.
+func fetchLatest(baseUrl *url.URL, token string, device *identity.Device) (*automerge.Doc, error) {
+	resp, err := auth.NewClient(token).Get(baseUrl.JoinPath("stores/default/latest").String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+
+		raw, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read body from get: %w", err)
+		}
+		if d, err := automerge.Load(raw); err != nil {
+			return nil, fmt.Errorf("failed to load doc: %w", err)
+		} else {
+			if err := d.SetActorID(device.ActorID()); err != nil {
+				return nil, fmt.Errorf("failed to set actor id: %w", err)
+			}
+			return d, nil
+		}
+	default:
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
 type client struct {
 	baseUrl *url.URL
+	token   string
+	device  *identity.Device
+	name    string
 	doc     *automerge.Doc
+	// docLock is held by the sync and by the batch while it merges, local edits go through the batch
+	docLock sync.Mutex
+	batch   *batch.Batcher
+	// docKey is set when syncing through the encrypted relay
+	docKey []byte
+
+	// readOnly is set when the server tells us that our role on the store does not allow writes
+	readOnly atomic.Bool
 }
 
 func (c *client) connectAndSyncContinuously(ctx context.Context) {
@@ -118,7 +182,17 @@ func (c *client) connectAndSyncContinuously(ctx context.Context) {
 	for {
 		select {
 		case <-t.C:
-			if err := c.connectAndSync(ctx); err != nil {
+			var epochErr *pkg.EpochError
+			var rejectedErr *pkg.RejectedError
+			if err := c.connectAndSync(ctx); errors.As(err, &epochErr) {
+				// this doc is archived, and only exists in memory, so the new epoch is simply fetched on restart
+				slog.Error("stopping sync, restart to continue on the new epoch", "err", err)
+				return
+			} else if errors.As(err, &rejectedErr) {
+				// the doc holds the rejected changes for good, so every sync would offer them again
+				slog.Error("stopping sync, the server rejected our changes", "changes", rejectedErr.Changes, "err", err)
+				return
+			} else if err != nil {
 				slog.Error("failed to sync", "err", err)
 			} else {
 				slog.Info("finished sync")
@@ -133,13 +207,31 @@ func (c *client) connectAndSyncContinuously(ctx context.Context) {
 func (c *client) connectAndSync(ctx context.Context) error {
 	u := c.baseUrl.JoinPath("stores/default/sync")
 	u.Scheme = "ws"
-	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	header, err := pkg.SetEpochHeader(auth.Header(c.token), c.doc)
+	if err != nil {
+		return err
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial(u.String(), header)
 	if err != nil {
-		return fmt.Errorf("failed to dial: %w", err)
+		return pkg.CheckDialError(resp, err)
 	}
 	defer conn.Close()
+	if role := auth.Role(resp.Header.Get(auth.RoleHeader)); role != "" && !role.CanWrite() != c.readOnly.Load() {
+		c.readOnly.Store(!role.CanWrite())
+		slog.Info("store role changed", "role", role, "read_only", c.readOnly.Load())
+	}
 	syncState := automerge.NewSyncState(c.doc)
-	if err := pkg.Sync(ctx, conn, syncState); err != nil {
+	hooks := &pkg.Hooks{
+		DocLock: &c.docLock,
+		Wake:    c.batch.Flushed(),
+		BeforeSend: func(msg *automerge.SyncMessage, send func(pkg.ControlMessage) error) error {
+			if sigs := c.device.SignOwnChanges(msg.Changes(), nil); len(sigs) > 0 {
+				return send(pkg.ControlMessage{Type: pkg.ControlTypeSignatures, Signatures: sigs})
+			}
+			return nil
+		},
+	}
+	if err := pkg.Sync(ctx, conn, syncState, hooks); err != nil {
 		return fmt.Errorf("failed to sync: %w", err)
 	}
 	return nil
@@ -150,11 +242,29 @@ func (c *client) incrementRandomlyContinuously(ctx context.Context) {
 		t := time.NewTimer(time.Second + time.Second*time.Duration(rand.Intn(5)))
 		select {
 		case <-t.C:
-			if err := c.doc.Path("counter").Counter().Inc(1); err != nil {
+			if c.readOnly.Load() {
+				// the server would drop the change anyway
+				continue
+			}
+			// the increments gather in the batch and are committed together once its window has passed
+			err := c.batch.Edit(func(doc *automerge.Doc) (string, error) {
+				// this is repeated so that a name lost to a concurrently created names map is restored
+				named, err := identity.SetName(doc, c.device.ActorID(), c.name)
+				if err != nil {
+					return "", err
+				}
+				if err := doc.Path("counter").Counter().Inc(1); err != nil {
+					return "", err
+				}
+				value, _ := doc.Path("counter").Counter().Get()
+				slog.Info("incremented", "value", value)
+				if named != "" {
+					return batch.Message([]string{named, "increment counter"}), nil
+				}
+				return "increment counter", nil
+			})
+			if err != nil {
 				slog.Error("failed to increment counter", "err", err)
-			} else {
-				value, _ := c.doc.Path("counter").Counter().Get()
-				slog.Info("incremented", "heads", c.doc.Heads(), "value", value)
 			}
 		case <-ctx.Done():
 			slog.Info("stopping scheduled increment")
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+	"github.com/gorilla/websocket"
+
+	"github.com/astromechza/automerge-experiments/cmd/four/pkg"
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+)
+
+func (c *client) connectAndRelayContinuously(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := c.connectAndRelay(ctx); err != nil {
+				slog.Error("failed to relay", "err", err)
+			}
+		case <-ctx.Done():
+			slog.Info("stopping relay")
+			return
+		}
+	}
+}
+
+// connectAndRelay holds a relay connection open, applying changes from the other peers as they arrive and uploading
+// local changes shortly after they are made.
+func (c *client) connectAndRelay(ctx context.Context) error {
+	u := c.baseUrl.JoinPath("stores/default/relay")
+	u.Scheme = "ws"
+	conn, resp, err := websocket.DefaultDialer.Dial(u.String(), auth.Header(c.token))
+	if err != nil {
+		return fmt.Errorf("failed to dial: %w", err)
+	}
+	defer conn.Close()
+	if role := auth.Role(resp.Header.Get(auth.RoleHeader)); role != "" && !role.CanWrite() != c.readOnly.Load() {
+		c.readOnly.Store(!role.CanWrite())
+		slog.Info("store role changed", "role", role, "read_only", c.readOnly.Load())
+	}
+
+	var writeLock sync.Mutex
+	send := func(msg pkg.RelayMessage) error {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		return conn.WriteJSON(msg)
+	}
+	// upload sends every change after the given heads, the relay ignores the ones it already has
+	upload := func(since []automerge.ChangeHash) ([]automerge.ChangeHash, error) {
+		heads := c.doc.Heads()
+		if c.readOnly.Load() {
+			return heads, nil
+		}
+		sealed, err := pkg.SealChangesSince(c.docKey, c.doc, since)
+		if err != nil {
+			return nil, err
+		} else if len(sealed) == 0 {
+			return heads, nil
+		}
+		if err := send(pkg.RelayMessage{Type: pkg.RelayTypeChanges, Changes: sealed}); err != nil {
+			return nil, fmt.Errorf("failed to send changes: %w", err)
+		}
+		slog.Info("uploaded changes", "changes", len(sealed), "heads", heads)
+		return heads, nil
+	}
+
+	if err := send(pkg.RelayMessage{Type: pkg.RelayTypeHello, Heads: changehash.Encode(c.doc.Heads())}); err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-subCtx.Done()
+		_ = conn.Close()
+	}()
+
+	// nothing is uploaded until the relay's heads are known, since until then there is nothing to upload against
+	var uploadLock sync.Mutex
+	var uploaded []automerge.ChangeHash
+	var ready bool
+	uploadPending := func() {
+		uploadLock.Lock()
+		defer uploadLock.Unlock()
+		if ready && !slices.Equal(uploaded, c.doc.Heads()) {
+			if next, err := upload(uploaded); err != nil {
+				slog.Error("failed to upload", "err", err)
+				cancel()
+			} else {
+				uploaded = next
+			}
+		}
+	}
+	go func() {
+		t := time.NewTicker(time.Millisecond * 500)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				uploadPending()
+			case <-c.batch.Flushed():
+				uploadPending()
+			case <-subCtx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		var msg pkg.RelayMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read: %w", err)
+		}
+		switch msg.Type {
+		case pkg.RelayTypeChanges:
+			if len(msg.Changes) > 0 {
+				if err := pkg.ApplyEncryptedChanges(c.docKey, c.doc, msg.Changes); err != nil {
+					return err
+				}
+				value, _ := c.doc.Path("counter").Counter().Get()
+				slog.Info("applied relayed changes", "changes", len(msg.Changes), "heads", c.doc.Heads(), "value", value)
+			}
+		case pkg.RelayTypeHeads:
+			// every change the relay had that we lacked was sent ahead of its heads, so they are all known locally
+			since, err := changehash.Decode(msg.Heads)
+			if err != nil {
+				return fmt.Errorf("invalid relay heads: %w", err)
+			}
+			uploadLock.Lock()
+			next, err := upload(since)
+			if err == nil {
+				uploaded, ready = next, true
+			}
+			uploadLock.Unlock()
+			if err != nil {
+				return err
+			}
+		case pkg.RelayTypeError:
+			return fmt.Errorf("relay closed the connection: %s", msg.Error)
+		default:
+			return fmt.Errorf("unexpected relay message type %q", msg.Type)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/astromechza/automerge-experiments/pkg/identity"
+)
+
+// ErrRejected wraps the reason that changes from the peer were refused. The reason is sent to the peer in an error
+// control message before the connection is closed.
+var ErrRejected = errors.New("changes rejected")
+
+// RejectedError names the changes from the peer that were refused, which is ErrRejected. The peer receives the hashes
+// with the reason, and should stop syncing rather than offer the same changes again.
+type RejectedError struct {
+	Changes []string
+	Err     error
+	// fromPeer is set when the peer refused our changes, rather than us refusing its
+	fromPeer bool
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrRejected, e.Err)
+}
+
+func (e *RejectedError) Unwrap() []error {
+	return []error{ErrRejected, e.Err}
+}
+
+const (
+	// ControlTypeError carries an explanation of why the sender is about to close the connection.
+	ControlTypeError = "error"
+	// ControlTypeRejected is an error that also names the changes of the peer that were refused, see RejectedError.
+	ControlTypeRejected = "rejected"
+	// ControlTypeSignatures carries signatures of changes authored by the sender. They are sent before the sync
+	// messages that carry the changes themselves.
+	ControlTypeSignatures = "signatures"
+	// ControlTypePresence carries ephemeral state about a peer, such as which task it is looking at. Presence is never
+	// stored: the server relays it to the other sessions of the same store, and tells them when the session is gone.
+	ControlTypePresence = "presence"
+	// ControlTypeStatus tells the peer how many of the sender's changes it lacks, going by the heads of its last sync
+	// message, so that it can show how far along the sync is. The server sends it ahead of a sync message whenever the
+	// count has changed.
+	ControlTypeStatus = "status"
+	// ControlTypeEpoch tells the peer that the store has started a new epoch, so the doc it is syncing is archived and
+	// it must migrate to the new one, see EpochHeader. The server sends it to every session of the store.
+	ControlTypeEpoch = "epoch"
+)
+
+// ControlMessage is sent as a websocket text frame alongside the binary automerge sync frames.
+type ControlMessage struct {
+	Type       string               `json:"type"`
+	Error      string               `json:"error,omitempty"`
+	Rejected   []string             `json:"rejected,omitempty"`
+	Signatures []identity.Signature `json:"signatures,omitempty"`
+	Presence   *Presence            `json:"presence,omitempty"`
+	Missing    int                  `json:"missing"`
+	Epoch      int                  `json:"epoch,omitempty"`
+}
+
+// SessionHeader is set on sync responses to the id of the session. Clients sign it with their device key and send the
+// proof with their presence, so that the server can tell the others which actor is behind the session.
+const SessionHeader = "X-Sync-Session"
+
+// Presence is what a peer is doing right now. Clients send their own presence as a heartbeat and whenever it changes,
+// and should forget peers they have not heard from in a few heartbeats in case the gone message never arrives.
+type Presence struct {
+	// Session identifies the connection that the presence belongs to, it is set by the server.
+	Session string `json:"session,omitempty"`
+	// Subject is the authenticated subject of the session, it is set by the server.
+	Subject string `json:"subject,omitempty"`
+	// Actor is the actor of the device key that proved the session, it is set by the server and is empty if the
+	// session has not proved one.
+	Actor string `json:"actor,omitempty"`
+	// Name is the display name of the actor recorded in the store, it is set by the server.
+	Name string `json:"name,omitempty"`
+	// Proof is sent by the client to prove its actor, see SessionHeader. The server never passes it on.
+	Proof *identity.Proof `json:"proof,omitempty"`
+	// Focus is the id of the item the peer is looking at.
+	Focus  string `json:"focus,omitempty"`
+	Typing bool   `json:"typing,omitempty"`
+	// Gone is set by the server when the session disconnects.
+	Gone bool `json:"gone,omitempty"`
+}
+
+// lockedConn serialises writes to the websocket, which does not support concurrent writers.
+type lockedConn struct {
+	*websocket.Conn
+	lock sync.Mutex
+}
+
+func (c *lockedConn) WriteMessage(messageType int, data []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+func (c *lockedConn) WriteControlMessage(msg ControlMessage) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode control message: %w", err)
+	}
+	return c.WriteMessage(websocket.TextMessage, raw)
+}
+
+// readControlMessage decodes a control message, and returns an error if it is an error message from the peer.
+func readControlMessage(p []byte) (ControlMessage, error) {
+	var msg ControlMessage
+	if err := json.Unmarshal(p, &msg); err != nil {
+		return msg, fmt.Errorf("failed to decode control message: %w", err)
+	}
+	switch msg.Type {
+	case ControlTypeError:
+		return msg, fmt.Errorf("peer closed the sync: %s", msg.Error)
+	case ControlTypeRejected:
+		return msg, &RejectedError{Changes: msg.Rejected, Err: errors.New(msg.Error), fromPeer: true}
+	}
+	return msg, nil
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/automerge/automerge-go"
+	"github.com/gorilla/websocket"
+
+	"github.com/astromechza/automerge-experiments/pkg/epoch"
+)
+
+// EpochHeader carries the epoch of the doc that a peer wants to sync when it connects. If the store is in another
+// epoch the server refuses the connection with 409 Conflict and this header set to the epoch of the store, since
+// syncing docs from two epochs would duplicate everything in them.
+const EpochHeader = "X-Store-Epoch"
+
+// EpochError is returned when the store has moved to another epoch than the doc being synced.
+type EpochError struct {
+	Epoch int
+}
+
+func (e *EpochError) Error() string {
+	return fmt.Sprintf("the store has moved to epoch %d", e.Epoch)
+}
+
+// SetEpochHeader adds the epoch of the doc to the headers of a sync request.
+func SetEpochHeader(header http.Header, doc *automerge.Doc) (http.Header, error) {
+	info, err := epoch.Of(doc)
+	if err != nil {
+		return nil, err
+	}
+	header.Set(EpochHeader, strconv.Itoa(info.Number))
+	return header, nil
+}
+
+// CheckDialError returns an EpochError if the server refused to sync because the doc is from another epoch, and the
+// dial error otherwise.
+func CheckDialError(resp *http.Response, err error) error {
+	if errors.Is(err, websocket.ErrBadHandshake) && resp != nil && resp.StatusCode == http.StatusConflict {
+		if n, convErr := strconv.Atoi(resp.Header.Get(EpochHeader)); convErr == nil {
+			return &EpochError{Epoch: n}
+		}
+	}
+	return fmt.Errorf("failed to dial: %w", err)
+}
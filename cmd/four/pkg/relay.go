@@ -0,0 +1,160 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/automerge/automerge-go"
+)
+
+/*
+The relay protocol lets the server store and forward changes without being able to read them. Every frame is a JSON
+RelayMessage in a websocket text frame:
+
+1. The client sends "hello" with its current heads.
+2. The server sends "changes" with every stored change that is not an ancestor of those heads, in the order they were
+   stored, followed by "heads" with its own heads.
+3. The client applies the changes and answers the heads with "changes" carrying everything it has since them.
+4. From then on the client sends "changes" whenever it commits, and the server forwards every change it accepts to
+   the other clients of the store.
+5. A client that is done sends a close frame. The server handles frames in order, so it answers with "error" if it
+   refused changes sent before it, and otherwise with a close frame once it has accepted them all.
+
+Changes are sealed with AES-256-GCM under a document key shared out of band between the clients. Only the hash and
+dependencies are visible to the server, which it needs to order the changes and work out what each client is missing.
+The hash is bound to the ciphertext as additional data, and clients check it against the decrypted change.
+*/
+
+const (
+	RelayTypeHello   = "hello"
+	RelayTypeHeads   = "heads"
+	RelayTypeChanges = "changes"
+	RelayTypeError   = "error"
+)
+
+type RelayMessage struct {
+	Type    string            `json:"type"`
+	Heads   []string          `json:"heads,omitempty"`
+	Changes []EncryptedChange `json:"changes,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// EncryptedChange is an opaque change as seen by the relay.
+type EncryptedChange struct {
+	Hash string   `json:"hash"`
+	Deps []string `json:"deps"`
+	Blob []byte   `json:"blob"`
+}
+
+// LoadDocKey reads a hex encoded 32 byte document key from the value, or from the file if the value is empty.
+func LoadDocKey(value, file string) ([]byte, error) {
+	if value == "" && file != "" {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read document key: %w", err)
+		}
+		value = string(raw)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("document key must be 32 hex encoded bytes")
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealChange encrypts the change under the document key.
+func SealChange(key []byte, change *automerge.Change) (EncryptedChange, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return EncryptedChange{}, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(change.Save())+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return EncryptedChange{}, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	hash := change.Hash()
+	deps := make([]string, 0, len(change.Dependencies()))
+	for _, d := range change.Dependencies() {
+		deps = append(deps, d.String())
+	}
+	return EncryptedChange{
+		Hash: hash.String(),
+		Deps: deps,
+		Blob: gcm.Seal(nonce, nonce, change.Save(), hash[:]),
+	}, nil
+}
+
+// SealChangesSince seals every change of the doc after the heads, for uploading to the relay. The relay ignores the
+// ones it already has.
+func SealChangesSince(key []byte, doc *automerge.Doc, since []automerge.ChangeHash) ([]EncryptedChange, error) {
+	changes, err := doc.Changes(since...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changes: %w", err)
+	}
+	sealed := make([]EncryptedChange, 0, len(changes))
+	for _, change := range changes {
+		ec, err := SealChange(key, change)
+		if err != nil {
+			return nil, err
+		}
+		sealed = append(sealed, ec)
+	}
+	return sealed, nil
+}
+
+// OpenChange decrypts the change. The hash is authenticated along with the content, so the relay cannot swap changes
+// around, but the returned bytes can only be checked against it once they are loaded into a doc with their
+// dependencies.
+func OpenChange(key []byte, ec EncryptedChange) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := automerge.NewChangeHash(ec.Hash)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hash: %w", err)
+	}
+	if len(ec.Blob) < gcm.NonceSize() {
+		return nil, fmt.Errorf("change %s is too short", ec.Hash)
+	}
+	plain, err := gcm.Open(nil, ec.Blob[:gcm.NonceSize()], ec.Blob[gcm.NonceSize():], hash[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt change %s: %w", ec.Hash, err)
+	}
+	return plain, nil
+}
+
+// ApplyEncryptedChanges decrypts the changes into the doc and checks that each of them is the change it claimed to be.
+func ApplyEncryptedChanges(key []byte, doc *automerge.Doc, changes []EncryptedChange) error {
+	raw := make([]byte, 0)
+	for _, ec := range changes {
+		plain, err := OpenChange(key, ec)
+		if err != nil {
+			return err
+		}
+		raw = append(raw, plain...)
+	}
+	if err := doc.LoadIncremental(raw); err != nil {
+		return fmt.Errorf("failed to load changes: %w", err)
+	}
+	for _, ec := range changes {
+		hash, _ := automerge.NewChangeHash(ec.Hash)
+		if _, err := doc.Change(hash); err != nil {
+			return fmt.Errorf("decrypted changes did not include %s: %w", ec.Hash, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/perms"
+	"github.com/astromechza/automerge-experiments/pkg/syncprogress"
+)
+
+// Session is the server side of a single peer's sync connection. Incoming changes are received into a private fork of
+// the shared doc and only merged back into the shared doc if the session is allowed to write, so a read-only peer
+// still receives everything it is missing but can never modify the store.
+type Session struct {
+	doc       *automerge.Doc
+	fork      *automerge.Doc
+	syncState *automerge.SyncState
+	readOnly  bool
+
+	// Check, if set, is called with a copy of the shared doc with the new changes from the peer merged in, and the
+	// changes, before they are merged into the shared doc. If it returns an error the changes are rejected and the
+	// session ends.
+	Check func(merged *automerge.Doc, changes []*automerge.Change) error
+	// MergeLock, if set, is held while new changes from the peer are checked and merged into the shared doc. It must
+	// keep the other sessions of the doc from merging meanwhile, or Check would see a doc that is already out of date,
+	// and lets the server hold off merges while it replaces the doc.
+	MergeLock sync.Locker
+
+	// lock serialises the merges in both directions, the doc locks are taken in opposite orders by each of them.
+	lock sync.Mutex
+	// peerHeads are the heads in the peer's last sync message, heard is set once there has been one
+	peerHeads []automerge.ChangeHash
+	heard     bool
+	missing   syncprogress.MissingCounter
+}
+
+func NewSession(doc *automerge.Doc, readOnly bool) (*Session, error) {
+	fork, err := doc.Fork()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fork doc: %w", err)
+	}
+	return &Session{doc: doc, fork: fork, syncState: automerge.NewSyncState(fork), readOnly: readOnly}, nil
+}
+
+func (s *Session) ReadOnly() bool {
+	return s.readOnly
+}
+
+// ReceiveMessage applies the message to the session's fork, checks any new changes, and merges them into the shared
+// doc.
+func (s *Session) ReceiveMessage(msg []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	heads := s.fork.Heads()
+	sm, err := s.syncState.ReceiveMessage(msg)
+	if err != nil {
+		return err
+	}
+	s.peerHeads, s.heard = sm.Heads(), true
+	if len(sm.Changes()) == 0 || s.readOnly {
+		return nil
+	}
+	if s.MergeLock != nil {
+		s.MergeLock.Lock()
+		defer s.MergeLock.Unlock()
+	}
+	if s.Check != nil {
+		// the fork already contains the changes, but since the session ends on rejection that doesn't matter
+		changes, err := s.fork.Changes(heads...)
+		if err != nil {
+			return fmt.Errorf("failed to list new changes: %w", err)
+		}
+		// other sessions may have merged changes since the peer's fork was last brought up to date, so the changes are
+		// checked against the doc they will be merged into
+		merged, err := s.doc.Fork()
+		if err != nil {
+			return fmt.Errorf("failed to fork doc: %w", err)
+		} else if _, err := merged.Merge(s.fork); err != nil {
+			return fmt.Errorf("failed to merge session changes: %w", err)
+		}
+		if err := s.Check(merged, changes); err != nil {
+			return &RejectedError{Changes: rejected(changes, err), Err: err}
+		}
+	}
+	if _, err := s.doc.Merge(s.fork); err != nil {
+		return fmt.Errorf("failed to merge session changes: %w", err)
+	}
+	return nil
+}
+
+// Missing returns how many changes of the session's view of the doc the peer lacks, see syncprogress.MissingCounter,
+// and false if the peer has yet to send a sync message.
+func (s *Session) Missing() (int, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.heard {
+		return 0, false, nil
+	}
+	missing, err := s.missing.Count(s.fork, s.peerHeads)
+	return missing, err == nil, err
+}
+
+// GenerateMessage pulls any new changes from the shared doc into the fork and generates the next message for the peer.
+func (s *Session) GenerateMessage() (*automerge.SyncMessage, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.fork.Merge(s.doc); err != nil {
+		return nil, false, fmt.Errorf("failed to merge doc into session: %w", err)
+	}
+	msg, valid := s.syncState.GenerateMessage()
+	return msg, valid, nil
+}
+
+// rejected returns the hashes of the changes that the error from Check refuses: the change that broke a rule, which
+// the rest of the peer's changes may build on, or otherwise all of them.
+func rejected(changes []*automerge.Change, err error) []string {
+	var violation *perms.Violation
+	if errors.As(err, &violation) {
+		return []string{violation.Change.String()}
+	}
+	out := make([]string, len(changes))
+	for i, change := range changes {
+		out[i] = change.Hash().String()
+	}
+	return out
+}
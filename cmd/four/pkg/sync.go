@@ -2,18 +2,100 @@ package pkg
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"sync"
 	"time"
 
 	"github.com/automerge/automerge-go"
 	"github.com/gorilla/websocket"
+
+	"github.com/astromechza/automerge-experiments/pkg/syncprogress"
 )
 
+// syncer is one side of the sync exchange. It is implemented by a plain sync state for clients and by Session for
+// the server.
+type syncer interface {
+	ReceiveMessage(msg []byte) error
+	GenerateMessage() (*automerge.SyncMessage, bool, error)
+}
+
+type stateSyncer struct {
+	syncState    *automerge.SyncState
+	lock         sync.Locker
+	progress     *syncprogress.Tracker
+	afterReceive func(msg *automerge.SyncMessage) error
+}
+
+func newStateSyncer(syncState *automerge.SyncState, hooks *Hooks) *stateSyncer {
+	ss := &stateSyncer{syncState: syncState}
+	if hooks != nil {
+		ss.lock, ss.progress, ss.afterReceive = hooks.DocLock, hooks.Progress, hooks.AfterReceive
+	}
+	return ss
+}
+
+func (s *stateSyncer) ReceiveMessage(msg []byte) error {
+	if s.lock != nil {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+	}
+	sm, err := s.syncState.ReceiveMessage(msg)
+	if err != nil {
+		return err
+	}
+	if s.progress != nil {
+		s.progress.Received(1, len(msg), len(sm.Changes()), sm.Heads())
+	}
+	if s.afterReceive != nil {
+		return s.afterReceive(sm)
+	}
+	return nil
+}
+
+func (s *stateSyncer) GenerateMessage() (*automerge.SyncMessage, bool, error) {
+	if s.lock != nil {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+	}
+	msg, valid := s.syncState.GenerateMessage()
+	if msg != nil && s.progress != nil {
+		s.progress.Sent(1, len(msg.Bytes()))
+	}
+	return msg, valid, nil
+}
+
+// Hooks let the caller exchange control messages alongside the automerge sync, and coordinate with it. Any field may
+// be nil.
+type Hooks struct {
+	// DocLock is held while the sync reads or writes the doc, so that the caller can make edits that span several
+	// operations without a sync message landing in the middle of them.
+	DocLock sync.Locker
+	// BeforeSend is called before each outgoing sync message is written, with a function to send control messages
+	// ahead of it.
+	BeforeSend func(msg *automerge.SyncMessage, send func(ControlMessage) error) error
+	// AfterReceive is called after each incoming sync message is applied to the doc, while DocLock is still held so
+	// that no local edit can come between the two.
+	AfterReceive func(msg *automerge.SyncMessage) error
+	// OnControl is called with each control message from the peer that isn't handled by the sync itself. It is called
+	// from the same goroutine that receives sync messages so ordering between the two is preserved.
+	OnControl func(ControlMessage) error
+	// Outbox holds control messages to send as soon as possible rather than alongside sync messages, such as presence.
+	Outbox <-chan ControlMessage
+	// Wake makes the sync send what changed straight away rather than on its next tick, such as after a batch of
+	// local edits is committed.
+	Wake <-chan struct{}
+	// Progress tracks the sync from the client side, including the status messages from the server. It is updated
+	// while DocLock is held.
+	Progress *syncprogress.Tracker
+}
+
 func readAndReceiveMessage(
 	conn *websocket.Conn,
-	syncState *automerge.SyncState,
+	syncState syncer,
+	hooks *Hooks,
 ) error {
 	mt, p, err := conn.ReadMessage()
 	if err != nil {
@@ -21,19 +103,40 @@ func readAndReceiveMessage(
 	}
 	switch mt {
 	case websocket.BinaryMessage:
-		if _, err := syncState.ReceiveMessage(p); err != nil {
+		if err := syncState.ReceiveMessage(p); err != nil {
 			return fmt.Errorf("failed to receive message: %w", err)
 		}
+	case websocket.TextMessage:
+		msg, err := readControlMessage(p)
+		if err != nil {
+			return err
+		}
+		if msg.Type == ControlTypeStatus && hooks != nil && hooks.Progress != nil {
+			hooks.Progress.RemoteStatus(nil, msg.Missing)
+			return nil
+		}
+		if hooks != nil && hooks.OnControl != nil {
+			return hooks.OnControl(msg)
+		}
 	default:
 	}
 	return nil
 }
 
 func generateAndWriteMessage(
-	conn *websocket.Conn,
-	syncState *automerge.SyncState,
+	conn *lockedConn,
+	syncState syncer,
+	hooks *Hooks,
 ) (bool, error) {
-	if msg, valid := syncState.GenerateMessage(); msg != nil {
+	msg, valid, err := syncState.GenerateMessage()
+	if err != nil {
+		return false, fmt.Errorf("failed to generate message: %w", err)
+	} else if msg != nil {
+		if hooks != nil && hooks.BeforeSend != nil {
+			if err := hooks.BeforeSend(msg, conn.WriteControlMessage); err != nil {
+				return false, err
+			}
+		}
 		if err := conn.WriteMessage(websocket.BinaryMessage, msg.Bytes()); err != nil {
 			return false, fmt.Errorf("failed to write message: %w", err)
 		}
@@ -42,21 +145,106 @@ func generateAndWriteMessage(
 	return false, nil
 }
 
+// generateAndWriteAll writes messages until the sync state has nothing more to send.
+func generateAndWriteAll(
+	conn *lockedConn,
+	syncState syncer,
+	hooks *Hooks,
+) error {
+	for {
+		if ok, err := generateAndWriteMessage(conn, syncState, hooks); err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+	}
+}
+
+// Sync runs the sync exchange for the sync state over the websocket until the connection fails or the context is done.
 func Sync(
 	ctx context.Context,
 	conn *websocket.Conn,
 	syncState *automerge.SyncState,
+	hooks *Hooks,
+) error {
+	return runSync(ctx, conn, newStateSyncer(syncState, hooks), hooks)
+}
+
+// SyncOnce runs the sync exchange until the peer has been quiet for the idle duration, for clients that connect to
+// push and pull their changes and then exit. The idle duration must be longer than the peer takes to reply.
+func SyncOnce(
+	ctx context.Context,
+	conn *websocket.Conn,
+	syncState *automerge.SyncState,
+	hooks *Hooks,
+	idle time.Duration,
+) error {
+	ss := newStateSyncer(syncState, hooks)
+	if hooks != nil && hooks.Progress != nil {
+		defer hooks.Progress.Done()
+	}
+	lc := &lockedConn{Conn: conn}
+	for {
+		if err := generateAndWriteAll(lc, ss, hooks); err != nil {
+			return err
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(idle)); err != nil {
+			return fmt.Errorf("failed to set read deadline: %w", err)
+		}
+		if err := readAndReceiveMessage(conn, ss, hooks); err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// ServeSession runs the sync exchange for a server side session.
+func ServeSession(
+	ctx context.Context,
+	conn *websocket.Conn,
+	session *Session,
+	hooks *Hooks,
+) error {
+	return runSync(ctx, conn, session, hooks)
+}
+
+func runSync(
+	ctx context.Context,
+	conn *websocket.Conn,
+	syncState syncer,
+	hooks *Hooks,
 ) error {
 	slog.Info("syncing")
+	lc := &lockedConn{Conn: conn}
 
+	// a rejection, whether of the peer's changes or of ours, is returned so that the caller doesn't sync them again
+	var rejection error
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer conn.Close()
 		for {
-			if err := readAndReceiveMessage(conn, syncState); err != nil {
+			if err := readAndReceiveMessage(conn, syncState, hooks); err != nil {
 				slog.Error(err.Error())
+				var rejected *RejectedError
+				if errors.As(err, &rejected) {
+					rejection = err
+				}
+				if errors.Is(err, ErrRejected) && (rejected == nil || !rejected.fromPeer) {
+					// let the peer know why we're hanging up on it, and which of its changes to stop sending
+					msg := ControlMessage{Type: ControlTypeError, Error: err.Error()}
+					if rejected != nil {
+						msg = ControlMessage{Type: ControlTypeRejected, Error: rejected.Err.Error(), Rejected: rejected.Changes}
+					}
+					_ = lc.WriteControlMessage(msg)
+					_ = lc.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+				}
 				return
 			}
 		}
@@ -67,27 +255,34 @@ func Sync(
 		defer wg.Done()
 		defer conn.Close()
 
-		for {
-			if ok, err := generateAndWriteMessage(conn, syncState); err != nil {
-				slog.Error(err.Error())
-				return
-			} else if !ok {
-				break
-			}
+		if err := generateAndWriteAll(lc, syncState, hooks); err != nil {
+			slog.Error(err.Error())
+			return
 		}
 
+		var outbox <-chan ControlMessage
+		var wake <-chan struct{}
+		if hooks != nil {
+			outbox, wake = hooks.Outbox, hooks.Wake
+		}
 		t := time.NewTicker(time.Second)
 		defer t.Stop()
 		for {
 			select {
+			case msg := <-outbox:
+				if err := lc.WriteControlMessage(msg); err != nil {
+					slog.Error(err.Error())
+					return
+				}
+			case <-wake:
+				if err := generateAndWriteAll(lc, syncState, hooks); err != nil {
+					slog.Error(err.Error())
+					return
+				}
 			case <-t.C:
-				for {
-					if ok, err := generateAndWriteMessage(conn, syncState); err != nil {
-						slog.Error(err.Error())
-						return
-					} else if !ok {
-						break
-					}
+				if err := generateAndWriteAll(lc, syncState, hooks); err != nil {
+					slog.Error(err.Error())
+					return
 				}
 			case <-ctx.Done():
 				return
@@ -96,5 +291,5 @@ func Sync(
 	}()
 
 	wg.Wait()
-	return nil
+	return rejection
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/automerge/automerge-go"
+	"github.com/gorilla/mux"
+
+	"github.com/astromechza/automerge-experiments/cmd/four/pkg"
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+	"github.com/astromechza/automerge-experiments/pkg/epoch"
+	"github.com/astromechza/automerge-experiments/pkg/todo"
+)
+
+func (s *server) initEpochs() error {
+	if _, err := s.database.Exec(
+		`CREATE TABLE IF NOT EXISTS epochs (
+    	store_id text not null,
+    	number integer not null,
+    	heads text not null,
+    	content text not null,
+    	primary key (store_id, number)
+		)`,
+	); err != nil {
+		return fmt.Errorf("failed to create epochs table: %w", err)
+	}
+	return nil
+}
+
+// startEpoch compacts the history of the store by starting a new epoch, see package epoch. The old doc is archived so
+// that clients with changes the server never received can carry them forward, and the sessions still syncing it are
+// told to migrate. Only owners may do this, since every client has to migrate.
+func (s *server) startEpoch(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	role, ok := s.authorize(writer, request, vars["store"])
+	if !ok {
+		return
+	} else if role != auth.RoleOwner {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// no session may merge into the old doc once it has been copied, or its changes would be lost
+	s.epochLock.Lock()
+	defer s.epochLock.Unlock()
+	fromCacheRaw, ok := s.cache.Load(vars["store"])
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fromCache, ok := fromCacheRaw.(*automerge.Doc)
+	if !ok {
+		slog.Error("item in cache is not a doc")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	next, err := todo.NewEpoch(fromCache)
+	if err == nil && next == nil {
+		next, err = epoch.Start(fromCache, automerge.New())
+	}
+	if err != nil {
+		slog.Error("failed to start epoch", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	info, err := epoch.Of(next)
+	if err != nil {
+		slog.Error("failed to read epoch", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := s.database.BeginTx(request.Context(), nil)
+	if err != nil {
+		slog.Error("failed to begin", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.ExecContext(
+		request.Context(), `INSERT INTO epochs (store_id, number, heads, content) VALUES (?, ?, ?, ?)`,
+		vars["store"], info.Number-1, strings.Join(info.Previous, ","), base64.StdEncoding.EncodeToString(fromCache.Save()),
+	); err != nil {
+		slog.Error("failed to archive epoch", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.ExecContext(
+		request.Context(), `UPDATE stores SET content = ? WHERE id = ?`,
+		base64.StdEncoding.EncodeToString(next.Save()), vars["store"],
+	); err != nil {
+		slog.Error("failed to save epoch", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("failed to commit", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	s.cache.Store(vars["store"], next)
+	slog.Info("started epoch", "store", vars["store"], "epoch", info.Number, "previous", info.Previous, "heads", next.Heads())
+	s.presence.broadcast(vars["store"], pkg.ControlMessage{Type: pkg.ControlTypeEpoch, Epoch: info.Number})
+
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(info); err != nil {
+		slog.Error("failed to write out", "err", err)
+	}
+}
+
+// getEpoch returns the epoch of the store, so that clients can tell whether they need to migrate before syncing.
+func (s *server) getEpoch(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	if _, ok := s.authorize(writer, request, vars["store"]); !ok {
+		return
+	}
+	fromCacheRaw, ok := s.cache.Load(vars["store"])
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fromCache, ok := fromCacheRaw.(*automerge.Doc)
+	if !ok {
+		slog.Error("item in cache is not a doc")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	info, err := epoch.Of(fromCache)
+	if err != nil {
+		slog.Error("failed to read epoch", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(info); err != nil {
+		slog.Error("failed to write out", "err", err)
+	}
+}
+
+// getArchivedEpoch returns the final doc of an old epoch of the store, which clients merge their own changes into to
+// find the ones to carry forward.
+func (s *server) getArchivedEpoch(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	if _, ok := s.authorize(writer, request, vars["store"]); !ok {
+		return
+	}
+	number, err := strconv.Atoi(vars["number"])
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var content string
+	if err := s.database.QueryRowContext(
+		request.Context(), `SELECT content FROM epochs WHERE store_id = ? AND number = ?`, vars["store"], number,
+	).Scan(&content); err != nil {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	raw, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		slog.Error("failed to decode archive", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Add("Content-Type", "application/octet-stream")
+	if _, err := writer.Write(raw); err != nil {
+		slog.Error("failed to write out", "err", err)
+	}
+}
+
+// checkEpoch refuses a sync of a doc from another epoch than the store's, and returns false if it did.
+func checkEpoch(writer http.ResponseWriter, request *http.Request, doc *automerge.Doc) bool {
+	info, err := epoch.Of(doc)
+	if err != nil {
+		slog.Error("failed to read epoch", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	// clients from before epochs existed don't send the header, and their docs are epoch 0
+	claimed := 0
+	if raw := request.Header.Get(pkg.EpochHeader); raw != "" {
+		if claimed, err = strconv.Atoi(raw); err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+	}
+	if claimed != info.Number {
+		writer.Header().Set(pkg.EpochHeader, strconv.Itoa(info.Number))
+		writer.WriteHeader(http.StatusConflict)
+		return false
+	}
+	return true
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -24,6 +25,11 @@ import (
 	"github.com/automerge/automerge-go"
 
 	"github.com/astromechza/automerge-experiments/cmd/four/pkg"
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+	"github.com/astromechza/automerge-experiments/pkg/identity"
+	"github.com/astromechza/automerge-experiments/pkg/perms"
+	"github.com/astromechza/automerge-experiments/pkg/schema"
+	"github.com/astromechza/automerge-experiments/pkg/todo"
 	"github.com/astromechza/automerge-experiments/pkg/viz"
 )
 
@@ -36,16 +42,63 @@ func main() {
 
 func mainInner() error {
 	addrVar := flag.String("addr", "localhost:8080", "the address to listen on")
+	issueTokenVar := flag.String("issue-token", "", "issue a token for the given subject, print it, and exit")
+	tokenTtlVar := flag.Duration("token-ttl", time.Hour*24*30, "how long an issued token remains valid, 0 for no expiry")
+	revokeTokenVar := flag.String("revoke-token", "", "revoke the token with the given id and exit")
+	grantVar := flag.String("grant", "", "grant a role on a store in the form <store>:<subject>:<role> and exit")
+	rulesVar := flag.String("rules", "", "a json file of path-level write rules for each store")
+	requireSignaturesVar := flag.Bool("require-signatures", false, "reject changes that are not signed by their actor's device key")
+	schemasVar := flag.String("schemas", "", "a json file of the json schema of each store, checked after applying each peer's changes, stores without one that hold a todo list are checked against the todo schema (not in relay mode)")
+	migrateVar := flag.Bool("migrate", false, "migrate stores that hold todo lists to the latest schema version when they are loaded")
+	relayVar := flag.Bool("relay", false, "only serve the end-to-end encrypted relay, so the server never handles plaintext documents")
+	flag.Parse()
+
 	slog.Info("Opening database")
 	db, err := sql.Open("sqlite3", "four.sqlite3")
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	s := &server{database: db}
+	s := &server{
+		database:          db,
+		roles:             auth.NewRoleStore(db),
+		signatures:        identity.NewSignatureStore(db),
+		requireSignatures: *requireSignaturesVar,
+		relayStores:       make(map[string]*relayStore),
+		migrate:           *migrateVar,
+		relayOnly:         *relayVar,
+	}
+	if *rulesVar != "" {
+		if s.rules, err = perms.LoadConfig(*rulesVar); err != nil {
+			return err
+		}
+	}
+	if *schemasVar != "" {
+		if s.schemas, err = schema.LoadConfig(*schemasVar); err != nil {
+			return err
+		}
+	}
 	if err := s.init(); err != nil {
 		panic(err)
 	}
+	if *grantVar != "" {
+		return s.roles.GrantSpec(context.Background(), *grantVar)
+	}
+
+	tokens := auth.NewTokenStore(db)
+	if err := tokens.Init(); err != nil {
+		return err
+	}
+	if *issueTokenVar != "" {
+		token, err := tokens.Issue(context.Background(), *issueTokenVar, *tokenTtlVar)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	} else if *revokeTokenVar != "" {
+		return tokens.Revoke(context.Background(), *revokeTokenVar)
+	}
 
 	r := mux.NewRouter()
 	r.Use(func(handler http.Handler) http.Handler {
@@ -54,42 +107,29 @@ func mainInner() error {
 			slog.Info("handled", "method", request.Method, "url", request.URL, "duration", m.Duration, "status", m.Code)
 		})
 	})
+	r.Use(tokens.Middleware)
 
-	r.Methods(http.MethodGet).Path("/stores/{store}/latest").HandlerFunc(s.getStore)
-	r.Methods(http.MethodGet).Path("/stores/{store}/sync").HandlerFunc(s.syncStore)
+	r.Methods(http.MethodGet).Path("/stores/{store}/relay").HandlerFunc(s.relay)
+	if !s.relayOnly {
+		r.Methods(http.MethodGet).Path("/stores/{store}/latest").HandlerFunc(s.getStore)
+		r.Methods(http.MethodGet).Path("/stores/{store}/sync").HandlerFunc(s.syncStore)
+		r.Methods(http.MethodGet).Path("/stores/{store}/signatures").HandlerFunc(s.getSignatures)
+		r.Methods(http.MethodGet).Path("/stores/{store}/conflicts").HandlerFunc(s.getConflicts)
+		r.Methods(http.MethodGet).Path("/stores/{store}/epoch").HandlerFunc(s.getEpoch)
+		r.Methods(http.MethodPost).Path("/stores/{store}/epochs").HandlerFunc(s.startEpoch)
+		r.Methods(http.MethodGet).Path("/stores/{store}/epochs/{number}").HandlerFunc(s.getArchivedEpoch)
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	wg := new(sync.WaitGroup)
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		t := time.NewTicker(time.Second * 5)
-		defer t.Stop()
-		for {
-			select {
-			case <-t.C:
-				s.cache.Range(func(storeId, docRaw any) bool {
-					newContent := base64.StdEncoding.EncodeToString(docRaw.(*automerge.Doc).Save())
-					if res, err := s.database.ExecContext(
-						ctx, `UPDATE stores SET content = ? WHERE id = ? AND content != ? `,
-						newContent,
-						storeId,
-						newContent,
-					); err != nil {
-						slog.Error("failed to backup doc in database", "err", err)
-					} else if r, _ := res.RowsAffected(); r > 0 {
-						slog.Info("backed up", "store", storeId, "heads", docRaw.(*automerge.Doc).Heads())
-					}
-					return true
-				})
-			case <-ctx.Done():
-				return
-			}
-		}
-	}()
+	// in relay mode there are no plaintext stores to back up
+	if !s.relayOnly {
+		wg.Add(1)
+		go s.backupContinuously(ctx, wg)
+	}
 
 	httpServer := &http.Server{Addr: *addrVar, Handler: r}
 
@@ -97,7 +137,7 @@ func mainInner() error {
 	go func() {
 		defer wg.Done()
 		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			slog.Error("server listen failed", err.Error())
+			slog.Error("server listen failed", "err", err)
 		}
 	}()
 
@@ -135,7 +175,30 @@ func mainInner() error {
 
 type server struct {
 	database *sql.DB
+	roles    *auth.RoleStore
+	rules    perms.Config
+	schemas  schema.Config
 	cache    *sync.Map
+
+	signatures        *identity.SignatureStore
+	requireSignatures bool
+
+	// migrate upgrades todo stores as they are loaded, since every peer syncs through the server this usually means
+	// the clients receive the migration instead of running it themselves
+	migrate bool
+
+	// relayOnly serves only the encrypted relay, so plaintext stores are never loaded
+	relayOnly   bool
+	relayLock   sync.Mutex
+	relayStores map[string]*relayStore
+
+	// epochLock is held by sessions while they merge changes into a doc and by the backup while it saves one, and by
+	// startEpoch while it replaces one
+	epochLock sync.RWMutex
+	// mergeLocks holds a *sync.Mutex for each store, which its sessions hold while they check and merge changes
+	mergeLocks sync.Map
+
+	presence presenceHub
 }
 
 func (s *server) init() error {
@@ -147,20 +210,42 @@ func (s *server) init() error {
 	); err != nil {
 		return err
 	}
+	if err := s.roles.Init(); err != nil {
+		return err
+	}
+	if err := s.signatures.Init(); err != nil {
+		return err
+	}
+	if err := s.initRelay(); err != nil {
+		return err
+	}
+	if err := s.initEpochs(); err != nil {
+		return err
+	}
+	s.cache = new(sync.Map)
+	if !s.relayOnly {
+		if err := s.loadStores(); err != nil {
+			return err
+		}
+	}
+	slog.Info("Ensured initial tables exist")
+	return nil
+}
+
+// loadStores loads every plaintext store into the cache, creating the default store if it does not exist yet.
+func (s *server) loadStores() error {
 	if _, err := s.database.Exec(
 		`INSERT OR IGNORE INTO stores (id, content) VALUES (?, ?)`,
 		"default", base64.StdEncoding.EncodeToString(automerge.New().Save()),
 	); err != nil {
 		return err
 	}
-	s.cache = new(sync.Map)
-
 	if res, err := s.database.Query(`SELECT id, content FROM stores`); err != nil {
 		return fmt.Errorf("failed to query: %w", err)
 	} else {
 		defer func(res *sql.Rows) {
 			if err := res.Close(); err != nil {
-				slog.Error("failed to close: %w", err)
+				slog.Error("failed to close", "err", err)
 			}
 		}(res)
 		for res.Next() {
@@ -174,16 +259,75 @@ func (s *server) init() error {
 			} else if doc, err := automerge.Load(raw); err != nil {
 				return fmt.Errorf("failed to load doc: %w", err)
 			} else {
+				if s.migrate {
+					if n, err := todo.Upgrade(doc); err != nil {
+						return fmt.Errorf("failed to migrate store %s: %w", storeId, err)
+					} else if n > 0 {
+						slog.Info("migrated store", "store", storeId, "migrations", n, "heads", doc.Heads())
+					}
+				}
 				s.cache.Store(storeId, doc)
 			}
 		}
 	}
-	slog.Info("Ensured initial tables exist")
 	return nil
 }
 
+// backupContinuously saves the cached stores to the database every few seconds, until the context is done.
+func (s *server) backupContinuously(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	t := time.NewTicker(time.Second * 5)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			s.cache.Range(func(storeId, docRaw any) bool {
+				// a new epoch may replace the doc while it is saved, and the archived doc must not be written back
+				// over it, so the backup holds off epochs and skips a doc that has been replaced
+				s.epochLock.RLock()
+				defer s.epochLock.RUnlock()
+				if current, _ := s.cache.Load(storeId); current != docRaw {
+					return true
+				}
+				newContent := base64.StdEncoding.EncodeToString(docRaw.(*automerge.Doc).Save())
+				if res, err := s.database.ExecContext(
+					ctx, `UPDATE stores SET content = ? WHERE id = ? AND content != ? `,
+					newContent,
+					storeId,
+					newContent,
+				); err != nil {
+					slog.Error("failed to backup doc in database", "err", err)
+				} else if r, _ := res.RowsAffected(); r > 0 {
+					slog.Info("backed up", "store", storeId, "heads", docRaw.(*automerge.Doc).Heads())
+				}
+				return true
+			})
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// authorize returns the role of the authenticated subject on the store, or writes an error response and returns false.
+func (s *server) authorize(writer http.ResponseWriter, request *http.Request, store string) (auth.Role, bool) {
+	role, err := s.roles.RoleOfRequest(request.Context(), store)
+	if err != nil {
+		if errors.Is(err, auth.ErrNoAccess) {
+			writer.WriteHeader(http.StatusForbidden)
+		} else {
+			slog.Error("failed to lookup role", "err", err)
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+		return "", false
+	}
+	return role, true
+}
+
 func (s *server) getStore(writer http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
+	if _, ok := s.authorize(writer, request, vars["store"]); !ok {
+		return
+	}
 	fromCacheRaw, ok := s.cache.Load(vars["store"])
 	if !ok {
 		writer.WriteHeader(http.StatusNotFound)
@@ -209,6 +353,10 @@ func (s *server) getStore(writer http.ResponseWriter, request *http.Request) {
 
 func (s *server) syncStore(writer http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
+	role, ok := s.authorize(writer, request, vars["store"])
+	if !ok {
+		return
+	}
 	fromCacheRaw, ok := s.cache.Load(vars["store"])
 	if !ok {
 		writer.WriteHeader(http.StatusNotFound)
@@ -221,20 +369,173 @@ func (s *server) syncStore(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	if !checkEpoch(writer, request, fromCache) {
+		return
+	}
+
+	// readers still sync, but their changes never make it out of the session's fork
+	session, err := pkg.NewSession(fromCache, !role.CanWrite())
+	if err != nil {
+		slog.Error("failed to start session", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// signatures arrive in control messages just ahead of the sync messages that carry their changes, both are handled
+	// on the same goroutine so no locking is needed
+	pendingSignatures := make(map[string]identity.Signature)
+	subject := ""
+	if token, ok := auth.FromContext(request.Context()); ok {
+		subject = token.Subject
+	}
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+	sessionId, outbox := s.presence.join(vars["store"], subject, cancel)
+	defer s.presence.leave(vars["store"], sessionId)
+	sentMissing := -1
+	hooks := &pkg.Hooks{
+		Outbox: outbox,
+		// the peer estimates its progress from how many of our changes it lacks
+		BeforeSend: func(_ *automerge.SyncMessage, send func(pkg.ControlMessage) error) error {
+			missing, ok, err := session.Missing()
+			if err != nil {
+				return err
+			} else if !ok || missing == sentMissing {
+				return nil
+			}
+			sentMissing = missing
+			return send(pkg.ControlMessage{Type: pkg.ControlTypeStatus, Missing: missing})
+		},
+		OnControl: func(msg pkg.ControlMessage) error {
+			switch msg.Type {
+			case pkg.ControlTypeSignatures:
+				for _, sig := range msg.Signatures {
+					pendingSignatures[sig.Hash] = sig
+				}
+			case pkg.ControlTypePresence:
+				if msg.Presence != nil {
+					s.presence.publish(vars["store"], sessionId, *msg.Presence, identity.Names(fromCache))
+				}
+			}
+			return nil
+		},
+	}
+	rules, storeSchema := s.rules[vars["store"]], s.schemas[vars["store"]]
+	storeLock, _ := s.mergeLocks.LoadOrStore(vars["store"], &sync.Mutex{})
+	session.MergeLock = &mergeLock{epoch: s.epochLock.RLocker(), store: storeLock.(*sync.Mutex)}
+	session.Check = func(merged *automerge.Doc, changes []*automerge.Change) error {
+		// the doc is archived once a new epoch starts, anything merged into it after that would be lost
+		if current, _ := s.cache.Load(vars["store"]); current != fromCache {
+			return fmt.Errorf("the store has moved to a new epoch")
+		}
+		if err := rules.Check(merged, changes); err != nil {
+			return err
+		}
+		if storeSchema != nil {
+			if err := storeSchema.ValidateDoc(merged); err != nil {
+				return err
+			}
+		} else if todo.IsList(merged) {
+			if err := todo.Schema.ValidateDoc(merged); err != nil {
+				return err
+			}
+		}
+		verified, err := identity.VerifyChanges(changes, pendingSignatures, s.requireSignatures, todo.Reproduced(merged))
+		if err != nil {
+			return err
+		}
+		for _, sig := range verified {
+			delete(pendingSignatures, sig.Hash)
+		}
+		return s.signatures.Put(request.Context(), vars["store"], verified)
+	}
+
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 	}
-	conn, err := upgrader.Upgrade(writer, request, nil)
+	conn, err := upgrader.Upgrade(writer, request, http.Header{
+		auth.RoleHeader:   {string(role)},
+		pkg.SessionHeader: {sessionId},
+	})
 	if err != nil {
 		slog.Error("failed to upgrade", "err", err)
 		return
 	}
 	defer conn.Close()
 
-	syncState := automerge.NewSyncState(fromCache)
-	if err := pkg.Sync(request.Context(), conn, syncState); err != nil {
+	if err := pkg.ServeSession(ctx, conn, session, hooks); err != nil {
 		slog.Error("failed to sync", "err", err)
 		_ = conn.Close()
 	}
 }
+
+// mergeLock is held by a session while it checks and merges changes into the doc of a store. It holds off new epochs,
+// and the other sessions of the store so that each checks its changes against the doc it merges them into.
+type mergeLock struct {
+	epoch sync.Locker
+	store *sync.Mutex
+}
+
+func (l *mergeLock) Lock() {
+	l.epoch.Lock()
+	l.store.Lock()
+}
+
+func (l *mergeLock) Unlock() {
+	l.store.Unlock()
+	l.epoch.Unlock()
+}
+
+// getSignatures lists the verified change signatures of the store so that authorship can be audited offline.
+func (s *server) getSignatures(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	if _, ok := s.authorize(writer, request, vars["store"]); !ok {
+		return
+	}
+	signatures, err := s.signatures.List(request.Context(), vars["store"])
+	if err != nil {
+		slog.Error("failed to list signatures", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(signatures); err != nil {
+		slog.Error("failed to write out", "err", err)
+	}
+}
+
+// getConflicts lists the keys of the store that hold concurrent conflicting values, see package conflicts.
+func (s *server) getConflicts(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	if _, ok := s.authorize(writer, request, vars["store"]); !ok {
+		return
+	}
+	fromCacheRaw, ok := s.cache.Load(vars["store"])
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	fromCache, ok := fromCacheRaw.(*automerge.Doc)
+	if !ok {
+		slog.Error("item in cache is not a doc")
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	// finding conflicts reads the whole history, so work on a fork rather than hold up syncing sessions
+	fork, err := fromCache.Fork()
+	if err != nil {
+		slog.Error("failed to fork", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	found, err := todo.Conflicts(fork)
+	if err != nil {
+		slog.Error("failed to find conflicts", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(found); err != nil {
+		slog.Error("failed to write out", "err", err)
+	}
+}
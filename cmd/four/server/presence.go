@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"sync"
+
+	"github.com/astromechza/automerge-experiments/cmd/four/pkg"
+)
+
+// presenceSession is one sync connection's view of the presence of the other sessions of its store.
+type presenceSession struct {
+	subject string
+	outbox  chan pkg.ControlMessage
+	last    *pkg.Presence
+	// end closes the session's connection
+	end func()
+}
+
+// presenceHub relays presence between the sync sessions of each store. Nothing is persisted, a session's presence
+// only lasts as long as its connection.
+type presenceHub struct {
+	lock     sync.Mutex
+	sessions map[string]map[string]*presenceSession
+}
+
+// deliver queues the message for the session and returns false if there was no room for it. Presence is ephemeral, so
+// a session that is not keeping up misses it rather than slowing down everyone else.
+func (p *presenceSession) deliver(msg pkg.ControlMessage) bool {
+	select {
+	case p.outbox <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// join registers a new session of the store and returns its id and the outbox of presence messages for it. It starts
+// with the current presence of the other sessions. End closes the session's connection, see broadcast.
+func (h *presenceHub) join(store, subject string, end func()) (string, chan pkg.ControlMessage) {
+	raw := make([]byte, 8)
+	_, _ = rand.Read(raw)
+	id := hex.EncodeToString(raw)
+	ps := &presenceSession{subject: subject, outbox: make(chan pkg.ControlMessage, 64), end: end}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.sessions == nil {
+		h.sessions = make(map[string]map[string]*presenceSession)
+	}
+	if h.sessions[store] == nil {
+		h.sessions[store] = make(map[string]*presenceSession)
+	}
+	for _, other := range h.sessions[store] {
+		if other.last != nil {
+			ps.deliver(pkg.ControlMessage{Type: pkg.ControlTypePresence, Presence: other.last})
+		}
+	}
+	h.sessions[store][id] = ps
+	return id, ps.outbox
+}
+
+// publish records the presence of the session and sends it to the other sessions of the store. The session and
+// subject are always set by the server, and the actor only when the session proves it with the actor's device key, so
+// that peers cannot impersonate each other. The name is the one recorded for the actor in the names.
+func (h *presenceHub) publish(store, id string, presence pkg.Presence, names map[string]string) {
+	actor := ""
+	if presence.Proof != nil {
+		var err error
+		if actor, err = presence.Proof.Verify(id); err != nil {
+			slog.Warn("ignoring presence proof", "store", store, "session", id, "err", err)
+			actor = ""
+		}
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ps, ok := h.sessions[store][id]
+	if !ok {
+		return
+	}
+	presence.Session, presence.Subject, presence.Gone = id, ps.subject, false
+	presence.Actor, presence.Name, presence.Proof = actor, names[actor], nil
+	ps.last = &presence
+	for otherId, other := range h.sessions[store] {
+		if otherId != id {
+			other.deliver(pkg.ControlMessage{Type: pkg.ControlTypePresence, Presence: &presence})
+		}
+	}
+}
+
+// leave removes the session and tells the others of the store that it has gone.
+func (h *presenceHub) leave(store, id string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	ps, ok := h.sessions[store][id]
+	if !ok {
+		return
+	}
+	delete(h.sessions[store], id)
+	if len(h.sessions[store]) == 0 {
+		delete(h.sessions, store)
+	}
+	if ps.last == nil {
+		return
+	}
+	slog.Info("session left", "store", store, "session", id, "subject", ps.subject)
+	gone := &pkg.Presence{Session: id, Subject: ps.subject, Actor: ps.last.Actor, Name: ps.last.Name, Gone: true}
+	for _, other := range h.sessions[store] {
+		other.deliver(pkg.ControlMessage{Type: pkg.ControlTypePresence, Presence: gone})
+	}
+}
+
+// broadcast sends the message to every session of the store. Unlike presence it must not be missed, so a session with
+// no room for it is closed instead, and the peer finds out when it reconnects.
+func (h *presenceHub) broadcast(store string, msg pkg.ControlMessage) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for id, ps := range h.sessions[store] {
+		if !ps.deliver(msg) {
+			slog.Warn("closing session that missed a broadcast", "store", store, "session", id, "type", msg.Type)
+			ps.end()
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+
+	"github.com/astromechza/automerge-experiments/cmd/four/pkg"
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+)
+
+// relayStore is the in-memory view of the encrypted changes of a store. The changes are kept in the order they were
+// accepted, and since a change is only accepted once its dependencies are, that order is causal.
+type relayStore struct {
+	lock    sync.Mutex
+	changes []pkg.EncryptedChange
+	deps    map[string][]string
+	heads   map[string]bool
+	peers   map[*relayPeer]bool
+}
+
+type relayPeer struct {
+	conn *websocket.Conn
+	lock sync.Mutex
+}
+
+func (p *relayPeer) send(msg pkg.RelayMessage) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.conn.WriteJSON(msg)
+}
+
+func (s *server) initRelay() error {
+	if _, err := s.database.Exec(
+		`CREATE TABLE IF NOT EXISTS relay_changes (
+    	seq integer primary key autoincrement,
+    	store_id text not null,
+    	hash text not null,
+    	deps text not null,
+    	blob blob not null,
+    	unique (store_id, hash)
+		)`,
+	); err != nil {
+		return fmt.Errorf("failed to create relay changes table: %w", err)
+	}
+	return nil
+}
+
+// relayStoreFor returns the relay state of the store, loading it from the database the first time.
+func (s *server) relayStoreFor(ctx context.Context, store string) (*relayStore, error) {
+	s.relayLock.Lock()
+	defer s.relayLock.Unlock()
+	if rs, ok := s.relayStores[store]; ok {
+		return rs, nil
+	}
+	rs := &relayStore{deps: make(map[string][]string), heads: make(map[string]bool), peers: make(map[*relayPeer]bool)}
+	rows, err := s.database.QueryContext(ctx, `SELECT hash, deps, blob FROM relay_changes WHERE store_id = ? ORDER BY seq`, store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query relay changes: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ec pkg.EncryptedChange
+		var rawDeps string
+		if err := rows.Scan(&ec.Hash, &rawDeps, &ec.Blob); err != nil {
+			return nil, fmt.Errorf("failed to scan: %w", err)
+		}
+		if err := json.Unmarshal([]byte(rawDeps), &ec.Deps); err != nil {
+			return nil, fmt.Errorf("failed to decode deps of %s: %w", ec.Hash, err)
+		}
+		rs.add(ec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.relayStores[store] = rs
+	return rs, nil
+}
+
+func (rs *relayStore) add(ec pkg.EncryptedChange) {
+	rs.changes = append(rs.changes, ec)
+	rs.deps[ec.Hash] = ec.Deps
+	rs.heads[ec.Hash] = true
+	for _, d := range ec.Deps {
+		delete(rs.heads, d)
+	}
+}
+
+// missing returns the changes that are not ancestors of the given heads. Heads the relay does not know are ignored,
+// the peer will upload them once it sees the relay's heads.
+func (rs *relayStore) missing(heads []string) []pkg.EncryptedChange {
+	seen := make(map[string]bool)
+	queue := make([]string, 0, len(heads))
+	for _, h := range heads {
+		if _, ok := rs.deps[h]; ok {
+			queue = append(queue, h)
+		}
+	}
+	for len(queue) > 0 {
+		h := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		queue = append(queue, rs.deps[h]...)
+	}
+	out := make([]pkg.EncryptedChange, 0)
+	for _, ec := range rs.changes {
+		if !seen[ec.Hash] {
+			out = append(out, ec)
+		}
+	}
+	return out
+}
+
+func (rs *relayStore) headList() []string {
+	out := make([]string, 0, len(rs.heads))
+	for h := range rs.heads {
+		out = append(out, h)
+	}
+	return out
+}
+
+// acceptRelayChanges stores the changes that are new to the relay and forwards them to the other peers.
+func (s *server) acceptRelayChanges(ctx context.Context, store string, rs *relayStore, from *relayPeer, changes []pkg.EncryptedChange, canWrite bool) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	accepted := make([]pkg.EncryptedChange, 0, len(changes))
+	for _, ec := range changes {
+		if _, ok := rs.deps[ec.Hash]; ok {
+			continue
+		}
+		if !canWrite {
+			return fmt.Errorf("%w: read only role", pkg.ErrRejected)
+		}
+		for _, d := range ec.Deps {
+			if _, ok := rs.deps[d]; !ok {
+				return fmt.Errorf("%w: change %s depends on unknown change %s", pkg.ErrRejected, ec.Hash, d)
+			}
+		}
+		rawDeps, _ := json.Marshal(ec.Deps)
+		if _, err := s.database.ExecContext(
+			ctx, `INSERT INTO relay_changes(store_id, hash, deps, blob) VALUES (?, ?, ?, ?)`,
+			store, ec.Hash, string(rawDeps), ec.Blob,
+		); err != nil {
+			return fmt.Errorf("failed to store relay change: %w", err)
+		}
+		rs.add(ec)
+		accepted = append(accepted, ec)
+	}
+	if len(accepted) == 0 {
+		return nil
+	}
+	slog.Info("relayed changes", "store", store, "changes", len(accepted), "heads", rs.headList())
+	for peer := range rs.peers {
+		if peer == from {
+			continue
+		}
+		if err := peer.send(pkg.RelayMessage{Type: pkg.RelayTypeChanges, Changes: accepted}); err != nil {
+			slog.Error("failed to forward relay changes", "err", err)
+		}
+	}
+	return nil
+}
+
+// relay serves the end-to-end encrypted relay protocol described in the pkg package.
+func (s *server) relay(writer http.ResponseWriter, request *http.Request) {
+	vars := mux.Vars(request)
+	role, ok := s.authorize(writer, request, vars["store"])
+	if !ok {
+		return
+	}
+	rs, err := s.relayStoreFor(request.Context(), vars["store"])
+	if err != nil {
+		slog.Error("failed to load relay store", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+	conn, err := upgrader.Upgrade(writer, request, http.Header{auth.RoleHeader: {string(role)}})
+	if err != nil {
+		slog.Error("failed to upgrade", "err", err)
+		return
+	}
+	defer conn.Close()
+	peer := &relayPeer{conn: conn}
+	defer func() {
+		rs.lock.Lock()
+		delete(rs.peers, peer)
+		rs.lock.Unlock()
+	}()
+
+	if err := s.servePeer(request.Context(), vars["store"], rs, peer, role.CanWrite()); err != nil {
+		slog.Error("failed to relay", "err", err)
+		_ = peer.send(pkg.RelayMessage{Type: pkg.RelayTypeError, Error: err.Error()})
+	}
+}
+
+func (s *server) servePeer(ctx context.Context, store string, rs *relayStore, peer *relayPeer, canWrite bool) error {
+	for {
+		var msg pkg.RelayMessage
+		if err := peer.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return fmt.Errorf("failed to read: %w", err)
+		}
+		switch msg.Type {
+		case pkg.RelayTypeHello:
+			// the peer is only registered for forwarding once it has been sent the backlog, so that it receives
+			// changes in causal order
+			rs.lock.Lock()
+			backlog, heads := rs.missing(msg.Heads), rs.headList()
+			err := peer.send(pkg.RelayMessage{Type: pkg.RelayTypeChanges, Changes: backlog})
+			if err == nil {
+				err = peer.send(pkg.RelayMessage{Type: pkg.RelayTypeHeads, Heads: heads})
+			}
+			rs.peers[peer] = true
+			rs.lock.Unlock()
+			if err != nil {
+				return fmt.Errorf("failed to send backlog: %w", err)
+			}
+		case pkg.RelayTypeChanges:
+			if err := s.acceptRelayChanges(ctx, store, rs, peer, msg.Changes, canWrite); err != nil {
+				return err
+			}
+		case pkg.RelayTypeError:
+			return fmt.Errorf("peer closed the relay: %s", msg.Error)
+		default:
+			return fmt.Errorf("unexpected relay message type %q", msg.Type)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -19,6 +18,13 @@ import (
 	"time"
 
 	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/cmd/three/pkg"
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+	"github.com/astromechza/automerge-experiments/pkg/batch"
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+	"github.com/astromechza/automerge-experiments/pkg/handle"
+	"github.com/astromechza/automerge-experiments/pkg/identity"
 )
 
 func main() {
@@ -30,16 +36,36 @@ func main() {
 
 func mainInner() error {
 	addrVar := flag.String("addr", "127.0.0.1:8080", "the address to request on")
+	tokenVar := flag.String("token", "", "the bearer token to authenticate with, defaults to $"+auth.TokenEnvVar)
+	tokenFileVar := flag.String("token-file", "", "a file containing the bearer token to authenticate with")
+	identityVar := flag.String("identity", "", "the device key file, created if it does not exist, defaults to one in the user config dir")
+	nameVar := flag.String("name", "", "a display name for this device, recorded in the doc so that its changes can be attributed")
+	batchWindowVar := flag.Duration("batch-window", batch.DefaultWindow, "how long to gather local edits into one commit, zero commits every edit")
+	flag.Parse()
 	baseUrl, err := url.Parse("http://" + *addrVar)
 	if err != nil {
 		return err
 	}
+	token, err := auth.ResolveToken(*tokenVar, *tokenFileVar)
+	if err != nil {
+		return err
+	}
+	httpClient := auth.NewClient(token)
+	if *identityVar == "" {
+		if *identityVar, err = identity.DefaultPath(); err != nil {
+			return err
+		}
+	}
+	device, err := identity.LoadOrCreate(*identityVar)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
 
 	var doc *automerge.Doc
-	docLock := new(sync.Mutex)
 
 	slog.Info("Checking current state", "url", baseUrl.JoinPath("get").String())
-	resp, err := http.DefaultClient.Get(baseUrl.JoinPath("get").String())
+	resp, err := httpClient.Get(baseUrl.JoinPath("get").String())
 	if err != nil {
 		return fmt.Errorf("failed to get: %w", err)
 	}
@@ -59,7 +85,9 @@ func mainInner() error {
 			return fmt.Errorf("failed to load doc: %w", err)
 		} else {
 			doc = d
-			_ = doc.SetActorID(hex.EncodeToString([]byte(fmt.Sprintf("%d", os.Getpid()))))
+			if err := doc.SetActorID(device.ActorID()); err != nil {
+				return fmt.Errorf("failed to set actor id: %w", err)
+			}
 		}
 	case http.StatusNoContent:
 	default:
@@ -69,7 +97,9 @@ func mainInner() error {
 	if doc == nil {
 		slog.Info("no remote state, creating new doc")
 		doc = automerge.New()
-		_ = doc.SetActorID(hex.EncodeToString([]byte(fmt.Sprintf("%d", os.Getpid()))))
+		if err := doc.SetActorID(device.ActorID()); err != nil {
+			return fmt.Errorf("failed to set actor id: %w", err)
+		}
 		_, _ = doc.Commit("seed", automerge.CommitOptions{AllowEmpty: true})
 
 		body, _ := json.Marshal(map[string]interface{}{
@@ -77,7 +107,7 @@ func mainInner() error {
 		})
 
 		slog.Info("Uploading new state", "url", baseUrl.JoinPath("new").String())
-		resp, err := http.DefaultClient.Post(baseUrl.JoinPath("new").String(), "application/json", bytes.NewReader(body))
+		resp, err := httpClient.Post(baseUrl.JoinPath("new").String(), "application/json", bytes.NewReader(body))
 		if err != nil {
 			return fmt.Errorf("failed to create request: %w", err)
 		}
@@ -91,85 +121,83 @@ func mainInner() error {
 
 	slog.Info("established base doc", "heads", doc.Heads())
 
+	// docLock is held around every sync and edit, and reports what each of them changed
+	docLock, err := handle.New(doc)
+	if err != nil {
+		return err
+	}
+	docLock.Subscribe(func(patches []handle.Patch) {
+		for _, p := range patches {
+			slog.Info("doc changed", "patch", p.String())
+		}
+	})
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	wg := new(sync.WaitGroup)
 
+	syncClient := pkg.NewClient(baseUrl, doc)
+	syncClient.HttpClient = httpClient
+	syncClient.Device = device
+
+	// edits gather in the batch, and localChanges is poked whenever it is committed so that the sync loop pushes it
+	// without waiting for the watch
+	batcher := batch.New(doc, docLock)
+	batcher.Window = *batchWindowVar
+	localChanges := batcher.Flushed()
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		t := time.NewTicker(time.Second)
-		defer t.Stop()
-
-		var lastCookie *string
-		syncState := automerge.NewSyncState(doc)
 
 		inner := func() bool {
-			select {
-			case <-t.C:
-				docLock.Lock()
-				defer docLock.Unlock()
-				slog.Info("attempting sync")
-
-				outGoingMessages := make([][]byte, 0)
-				if lastCookie != nil {
-					for {
-						msg, valid := syncState.GenerateMessage()
-						if !valid {
-							break
-						}
-						outGoingMessages = append(outGoingMessages, msg.Bytes())
-					}
-				}
-
-				body, err := json.Marshal(map[string]interface{}{
-					"cookie":   lastCookie,
-					"messages": outGoingMessages,
-				})
-				if err != nil {
-					slog.Error("failed to encode body", "err", err)
-					break
-				}
-
-				slog.Info("sending sync request")
-				resp, err := http.DefaultClient.Post(baseUrl.JoinPath("sync").String(), "application/json", bytes.NewReader(body))
-				if err != nil {
-					slog.Error("failed to start sync", "err", err)
-					break
-				}
-				defer resp.Body.Close()
-				switch resp.StatusCode {
-				case http.StatusOK:
-					slog.Info("got sync response")
-				default:
-					slog.Error("unexpected status code", "code", resp.StatusCode)
-					break
-				}
-
-				var out struct {
-					Cookie   string   `json:"cookie"`
-					Messages [][]byte `json:"messages"`
-				}
-				if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-					slog.Error("failed to read sync body", "err", err)
-					break
-				}
+			docLock.Lock()
+			slog.Info("attempting sync")
+			err := syncClient.Sync(ctx, func(p pkg.Progress) {
+				slog.Info("sync round", "round", p.Round, "sent", p.MessagesSent, "received", p.MessagesReceived, "bytes_sent", p.BytesSent, "bytes_received", p.BytesReceived, "applied", p.ChangesApplied, "outstanding", p.Outstanding, "in_sync", p.InSync)
+			})
+			heads := syncClient.StoreHeads()
+			if err == nil {
+				slog.Info("doc heads", "heads", changehash.Encode(doc.Heads()), "store", heads)
+			}
+			docLock.Unlock()
 
-				if out.Cookie != "" {
-					lastCookie = &out.Cookie
+			if err != nil {
+				slog.Error("failed to sync", "err", err)
+				t := time.NewTimer(time.Second)
+				defer t.Stop()
+				select {
+				case <-t.C:
+					return true
+				case <-ctx.Done():
+					slog.Info("stopping sync")
+					return false
 				}
+			}
 
-				for _, message := range out.Messages {
-					if _, err := syncState.ReceiveMessage(message); err != nil {
-						slog.Error("failed to load sync message", "err", err)
-						break
+			// now sit in a long-poll until the server has something new for us, or we have something new for it
+			watchCtx, cancelWatch := context.WithCancel(ctx)
+			defer cancelWatch()
+			remoteChanges := make(chan error, 1)
+			go func() {
+				for {
+					changed, err := syncClient.Watch(watchCtx, heads, pkg.DefaultWatchTimeout)
+					if err != nil || changed {
+						remoteChanges <- err
+						return
 					}
 				}
-
-				slog.Info("doc heads", "heads", doc.Heads(), "map", doc.RootMap().GoString())
-
+			}()
+			select {
+			case err := <-remoteChanges:
+				if err != nil && ctx.Err() == nil {
+					slog.Error("failed to watch", "err", err)
+				}
+			case <-localChanges:
 			case <-ctx.Done():
-				slog.Info("stopping scheduled sync")
+			}
+			if ctx.Err() != nil {
+				slog.Info("stopping sync")
 				return false
 			}
 			return true
@@ -177,7 +205,7 @@ func mainInner() error {
 
 		for inner() {
 		}
-		slog.Info("stopped scheduled sync")
+		slog.Info("stopped sync")
 
 	}()
 
@@ -189,16 +217,28 @@ func mainInner() error {
 			t := time.NewTimer(time.Second + time.Second*time.Duration(rand.Intn(5)))
 			select {
 			case <-t.C:
-				docLock.Lock()
-				defer docLock.Unlock()
-				if err := doc.Path("counter").Counter().Inc(1); err != nil {
-					slog.Error("failed to increment counter", "err", err)
-				} else {
+				if syncClient.ReadOnly() {
+					// the server would reject the change anyway
+					return true
+				}
+				err := batcher.Edit(func(doc *automerge.Doc) (string, error) {
+					// this is repeated so that a name lost to a concurrently created names map is restored
+					named, err := identity.SetName(doc, device.ActorID(), *nameVar)
+					if err != nil {
+						return "", err
+					}
+					if err := doc.Path("counter").Counter().Inc(1); err != nil {
+						return "", err
+					}
 					count, _ := doc.Path("counter").Counter().Get()
 					slog.Info("counter incremented", "count", count)
-				}
-				if _, err := doc.Commit("incremented"); err != nil {
-					slog.Error("failed to commit doc", "err", err)
+					if named != "" {
+						return batch.Message([]string{named, "incremented"}), nil
+					}
+					return "incremented", nil
+				})
+				if err != nil {
+					slog.Error("failed to increment counter", "err", err)
 				}
 			case <-ctx.Done():
 				slog.Info("stopping scheduled increment")
@@ -0,0 +1,214 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+	"github.com/astromechza/automerge-experiments/pkg/identity"
+	"github.com/astromechza/automerge-experiments/pkg/syncprogress"
+)
+
+// DefaultMaxRounds bounds a single call to Client.Sync so that a misbehaving server cannot keep us looping forever.
+const DefaultMaxRounds = 1000
+
+// Progress is reported to the caller of Client.Sync after every round. InSync is only set once the server also has
+// nothing left to send.
+type Progress struct {
+	Round int
+	syncprogress.Progress
+}
+
+// Client runs the client side of the sync protocol for a single doc. The cookie and sync state are kept between calls
+// to Sync so that subsequent syncs only exchange what changed.
+type Client struct {
+	BaseUrl       *url.URL
+	HttpClient    *http.Client
+	MaxRoundBytes int
+	MaxRounds     int
+	// Device, if set, signs the changes we author before they are sent.
+	Device *identity.Device
+
+	doc       *automerge.Doc
+	cookie    []byte
+	syncState *automerge.SyncState
+	readOnly  atomic.Bool
+	// storeHeads are the heads of the store at the end of the last round
+	storeHeads []string
+}
+
+// ErrReadOnly is returned when the server rejected our changes because our role on the store does not allow writes.
+var ErrReadOnly = errors.New("store is read-only for this client")
+
+// StoreHeads returns the heads of the store at the end of the last sync, for Watch. They differ from the heads of the
+// doc if the store is read-only for us and we hold changes that it never took.
+func (c *Client) StoreHeads() []string {
+	return c.storeHeads
+}
+
+// ReadOnly returns true if the server last told us that we may not write to the store.
+func (c *Client) ReadOnly() bool {
+	return c.readOnly.Load()
+}
+
+func NewClient(baseUrl *url.URL, doc *automerge.Doc) *Client {
+	return &Client{
+		BaseUrl:    baseUrl,
+		HttpClient: http.DefaultClient,
+		doc:        doc,
+		syncState:  automerge.NewSyncState(doc),
+	}
+}
+
+// Reset drops the cookie and sync state so the next round starts from scratch.
+func (c *Client) Reset() {
+	c.cookie = nil
+	c.syncState = automerge.NewSyncState(c.doc)
+}
+
+// Sync performs rounds until both sides have the same heads and nothing is left to exchange. Progress, if not nil, is
+// called after each round. The caller must ensure the doc is not modified concurrently.
+func (c *Client) Sync(ctx context.Context, progress func(Progress)) error {
+	maxBytes, maxRounds := c.MaxRoundBytes, c.MaxRounds
+	if maxBytes <= 0 {
+		maxBytes = DefaultRoundBytes
+	}
+	if maxRounds <= 0 {
+		maxRounds = DefaultMaxRounds
+	}
+
+	tracker := syncprogress.NewTracker(c.doc, nil)
+	var p Progress
+	quietRounds := 0
+	for p.Round < maxRounds {
+		p.Round++
+		batch := GenerateMessages(c.syncState, maxBytes)
+		req := SyncRequest{
+			Cookie:   c.cookie,
+			Peer:     c.doc.ActorID(),
+			Heads:    changehash.Encode(c.doc.Heads()),
+			Messages: batch.Messages,
+		}
+		if c.Device != nil {
+			req.Signatures = c.Device.SignOwnChanges(batch.Changes, nil)
+		}
+		resp, err := c.round(ctx, req)
+		if err != nil {
+			if errors.Is(err, ErrInvalidCookie) {
+				c.Reset()
+				continue
+			}
+			return err
+		}
+		c.cookie = resp.Cookie
+		c.storeHeads = resp.Heads
+		if resp.StoreHeads != nil {
+			c.storeHeads = resp.StoreHeads
+		}
+		changes, err := ReceiveMessages(c.syncState, resp.Messages)
+		if err != nil {
+			return err
+		}
+
+		received := 0
+		for _, m := range resp.Messages {
+			received += len(m)
+		}
+		// the server counted what we miss before it generated the messages that carry some of it
+		tracker.Sent(len(batch.Messages), batch.Size)
+		tracker.RemoteStatus(resp.Heads, resp.Missing)
+		tracker.Received(len(resp.Messages), received, changes, nil)
+		p.Progress = tracker.Progress()
+		quiet := len(batch.Messages) == 0 && changes == 0 && !resp.More
+		p.InSync = quiet && SameHeads(resp.Heads, changehash.Encode(c.doc.Heads()))
+		if progress != nil {
+			progress(p)
+		}
+		if p.InSync {
+			return nil
+		} else if !quiet {
+			quietRounds = 0
+		} else if quietRounds++; quietRounds > 1 {
+			// a single quiet round is expected when the server only announced its heads, but after receiving them we
+			// should always have something to ask for
+			return fmt.Errorf("sync stalled after %d rounds with differing heads", p.Round)
+		}
+	}
+	return fmt.Errorf("not in sync after %d rounds", maxRounds)
+}
+
+// Watch long-polls the server until its heads differ from the given heads or the timeout passes. It returns true if
+// the heads differ and a sync should be run.
+func (c *Client) Watch(ctx context.Context, heads []string, timeout time.Duration) (bool, error) {
+	u := c.BaseUrl.JoinPath("watch")
+	u.RawQuery = url.Values{"heads": {strings.Join(heads, ",")}, "timeout": {timeout.String()}}.Encode()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := c.HttpClient.Do(httpReq)
+	if err != nil {
+		return false, fmt.Errorf("failed to send watch request: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNoContent:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+}
+
+func (c *Client) round(ctx context.Context, req SyncRequest) (*SyncResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode body: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseUrl.JoinPath("sync").String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := c.HttpClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send sync request: %w", err)
+	}
+	defer resp.Body.Close()
+	if role := auth.Role(resp.Header.Get(auth.RoleHeader)); role != "" {
+		c.readOnly.Store(!role.CanWrite())
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		return nil, ErrInvalidCookie
+	case http.StatusForbidden:
+		if c.readOnly.Load() {
+			return nil, ErrReadOnly
+		}
+		return nil, fmt.Errorf("forbidden")
+	case http.StatusUnprocessableEntity:
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("server rejected our changes: %s", strings.TrimSpace(string(reason)))
+	default:
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	var out SyncResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("failed to read sync body: %w", err)
+	}
+	return &out, nil
+}
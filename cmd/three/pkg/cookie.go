@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrInvalidCookie is returned when a sync cookie cannot be trusted. The client must restart the sync from scratch.
+var ErrInvalidCookie = errors.New("invalid sync cookie")
+
+// CookieSigner seals the encoded automerge sync state before it is handed to the client so that the state we later
+// reload is guaranteed to be one we produced ourselves, for the same store and peer, and recently.
+type CookieSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// sealedCookie is the payload we MAC. The State is the raw output of SyncState.Save(), and Held is the changes of a
+// read-only peer that the server keeps for it between rounds, see Server.Round.
+type sealedCookie struct {
+	Store   string `json:"s"`
+	Peer    string `json:"p"`
+	Expires int64  `json:"e"`
+	State   []byte `json:"st"`
+	Held    []byte `json:"h,omitempty"`
+}
+
+// NewCookieSigner returns a signer using the given key, or a random key if it is empty.
+func NewCookieSigner(key []byte, ttl time.Duration) (*CookieSigner, error) {
+	if len(key) == 0 {
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("failed to generate cookie key: %w", err)
+		}
+	}
+	return &CookieSigner{key: key, ttl: ttl}, nil
+}
+
+func (c *CookieSigner) mac(payload []byte) []byte {
+	h := hmac.New(sha256.New, c.key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// Seal binds the sync state and held changes to the store and peer and appends the MAC.
+func (c *CookieSigner) Seal(store, peer string, state, held []byte, now time.Time) ([]byte, error) {
+	payload, err := json.Marshal(sealedCookie{Store: store, Peer: peer, Expires: now.Add(c.ttl).Unix(), State: state, Held: held})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode cookie: %w", err)
+	}
+	return append(payload, c.mac(payload)...), nil
+}
+
+// Open verifies the MAC, binding, and expiry of the cookie and returns the inner sync state and held changes.
+func (c *CookieSigner) Open(store, peer string, cookie []byte, now time.Time) ([]byte, []byte, error) {
+	if len(cookie) <= sha256.Size {
+		return nil, nil, fmt.Errorf("%w: too short", ErrInvalidCookie)
+	}
+	payload, sum := cookie[:len(cookie)-sha256.Size], cookie[len(cookie)-sha256.Size:]
+	if !hmac.Equal(sum, c.mac(payload)) {
+		return nil, nil, fmt.Errorf("%w: bad signature", ErrInvalidCookie)
+	}
+	var sc sealedCookie
+	if err := json.Unmarshal(payload, &sc); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidCookie, err)
+	}
+	if sc.Store != store || sc.Peer != peer {
+		return nil, nil, fmt.Errorf("%w: issued for a different store or peer", ErrInvalidCookie)
+	}
+	if now.Unix() > sc.Expires {
+		return nil, nil, fmt.Errorf("%w: expired", ErrInvalidCookie)
+	}
+	return sc.State, sc.Held, nil
+}
@@ -0,0 +1,38 @@
+package pkg
+
+import (
+	"sync"
+)
+
+// Notifier lets long-poll requests wait for the next change to a store.
+type Notifier struct {
+	lock    sync.Mutex
+	waiters map[string]chan struct{}
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{waiters: make(map[string]chan struct{})}
+}
+
+// Wait returns a channel that is closed the next time Notify is called for the store. Callers should get the channel
+// before checking the current state of the store so that a change in between is not missed.
+func (n *Notifier) Wait(store string) <-chan struct{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	ch, ok := n.waiters[store]
+	if !ok {
+		ch = make(chan struct{})
+		n.waiters[store] = ch
+	}
+	return ch
+}
+
+// Notify wakes everything currently waiting on the store.
+func (n *Notifier) Notify(store string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if ch, ok := n.waiters[store]; ok {
+		close(ch)
+		delete(n.waiters, store)
+	}
+}
@@ -0,0 +1,132 @@
+// Package pkg implements the stateless HTTP sync protocol used by the cmd/three client and server.
+//
+// A sync is a sequence of rounds. Each round is a single `POST /sync` request carrying a SyncRequest and answered
+// with a SyncResponse:
+//
+//  1. The client generates outgoing automerge sync messages from its sync state until it has nothing more to send or
+//     the round's byte budget is spent, and posts them along with the cookie from the previous round (none on the
+//     first round), its peer id (actor id), its current heads, and signatures of the changes it authored.
+//  2. The server opens the cookie (or starts a fresh sync state if there is none), receives every incoming message,
+//     verifies and stores the signatures of the new changes, persists the document if its heads moved, and then
+//     generates its own messages within its byte budget. New changes with invalid signatures, or without signatures if
+//     the server requires them, are answered with 422 Unprocessable Entity and an explanation in the body.
+//  3. The server replies with a newly sealed cookie, its messages, its heads after the round, and whether it stopped
+//     generating early because of the budget.
+//  4. The client receives the messages and stores the cookie.
+//
+// Because the sync state stored in the cookie only retains the shared heads, the server will usually re-announce its
+// heads in a message every round. The client therefore repeats rounds until it has no messages to send, the server's
+// messages carried no changes and it has nothing more to send, and both sides report the same heads.
+//
+// If the server answers 412 Precondition Failed, the cookie was forged, stale, or issued to someone else: the client
+// drops the cookie and its sync state and restarts from the first round.
+//
+// Rather than polling the sync endpoint, an idle client can long-poll `GET /watch?heads=<h1>,<h2>&timeout=<duration>`
+// with its current heads. The server answers 200 with a WatchResponse as soon as the store's heads differ from the
+// given ones, or 204 No Content once the timeout passes without a change. On 200 the client runs a sync.
+package pkg
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/identity"
+)
+
+// DefaultRoundBytes is the default budget for the combined size of the messages sent by one side in a single round.
+const DefaultRoundBytes = 1 << 20
+
+type SyncRequest struct {
+	Cookie   []byte   `json:"cookie"`
+	Peer     string   `json:"peer"`
+	Heads    []string `json:"heads"`
+	Messages [][]byte `json:"messages"`
+	// Signatures are the client's signatures of the changes it authored that are carried by the messages.
+	Signatures []identity.Signature `json:"signatures,omitempty"`
+}
+
+type SyncResponse struct {
+	Cookie   []byte   `json:"cookie"`
+	Heads    []string `json:"heads"`
+	Messages [][]byte `json:"messages"`
+	More     bool     `json:"more"`
+	// Missing is how many of the server's changes the client lacks, going by the heads of its request, counted before
+	// the messages were generated, so that the client can estimate how many it is still to receive.
+	Missing int `json:"missing"`
+	// StoreHeads is set when the round ran on a fork for a read-only peer, see Server.Round, to the heads of the store
+	// itself. Heads is then the heads of the fork.
+	StoreHeads []string `json:"store_heads,omitempty"`
+}
+
+// DefaultWatchTimeout is how long a watch request is held open when the client does not ask for a timeout.
+const DefaultWatchTimeout = time.Second * 30
+
+// MaxWatchTimeout caps the timeout a client may ask for.
+const MaxWatchTimeout = time.Minute * 5
+
+type WatchResponse struct {
+	Heads []string `json:"heads"`
+}
+
+// Batch is the set of messages generated by one side for a round.
+type Batch struct {
+	Messages [][]byte
+	// Changes are all the changes carried by the messages.
+	Changes []*automerge.Change
+	Size    int
+	// More is true if generation stopped because the byte budget was spent.
+	More bool
+}
+
+// GenerateMessages pulls messages from the sync state until it has nothing more to send or maxBytes is reached. The
+// budget is checked before generating each message since a generated message is considered sent by the sync state, so
+// at least one message is always produced if there is one.
+func GenerateMessages(syncState *automerge.SyncState, maxBytes int) Batch {
+	out := Batch{Messages: make([][]byte, 0)}
+	for {
+		if len(out.Messages) > 0 && out.Size >= maxBytes {
+			out.More = true
+			return out
+		}
+		msg, valid := syncState.GenerateMessage()
+		if !valid {
+			return out
+		}
+		raw := msg.Bytes()
+		out.Messages = append(out.Messages, raw)
+		out.Changes = append(out.Changes, msg.Changes()...)
+		out.Size += len(raw)
+	}
+}
+
+// ReceiveMessages applies each message to the sync state in order and returns the number of changes they carried.
+func ReceiveMessages(syncState *automerge.SyncState, messages [][]byte) (int, error) {
+	changes := 0
+	for i, message := range messages {
+		msg, err := syncState.ReceiveMessage(message)
+		if err != nil {
+			return changes, fmt.Errorf("failed to receive message %d: %w", i, err)
+		}
+		changes += len(msg.Changes())
+	}
+	return changes, nil
+}
+
+// SameHeads returns true if both sets contain the same hashes regardless of order.
+func SameHeads(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]bool, len(a))
+	for _, h := range a {
+		seen[h] = true
+	}
+	for _, h := range b {
+		if !seen[h] {
+			return false
+		}
+	}
+	return true
+}
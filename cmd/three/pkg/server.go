@@ -0,0 +1,151 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+	"github.com/astromechza/automerge-experiments/pkg/syncprogress"
+)
+
+// ErrBadMessage is returned when an incoming sync message could not be applied to the document.
+var ErrBadMessage = errors.New("bad sync message")
+
+// Server handles the automerge side of a sync round. Loading and persisting the document is left to the caller.
+type Server struct {
+	Cookies       *CookieSigner
+	MaxRoundBytes int
+
+	// missing holds a *missingEntry for each store and peer that is syncing, so that rounds that change nothing don't
+	// count again. Only peers bound by a cookie get one, and it goes once the peer is in sync or its cookie would have
+	// expired, see sweepMissing.
+	missing   sync.Map
+	nextSweep atomic.Int64
+}
+
+type missingEntry struct {
+	counter syncprogress.MissingCounter
+	expires atomic.Int64
+}
+
+// countMissing counts the changes of the doc that the peer lacks. The peer is only trusted to be who it says once the
+// cookie has been checked, before that the count isn't cached.
+func (s *Server) countMissing(
+	store string,
+	doc *automerge.Doc,
+	req SyncRequest,
+	peerHeads []automerge.ChangeHash,
+	now time.Time,
+) (int, error) {
+	if req.Cookie == nil {
+		return new(syncprogress.MissingCounter).Count(doc, peerHeads)
+	}
+	s.sweepMissing(now)
+	key := store + "/" + req.Peer
+	raw, _ := s.missing.LoadOrStore(key, &missingEntry{})
+	entry := raw.(*missingEntry)
+	entry.expires.Store(now.Add(s.Cookies.ttl).Unix())
+	missing, err := entry.counter.Count(doc, peerHeads)
+	if err == nil && missing == 0 {
+		s.missing.CompareAndDelete(key, entry)
+	}
+	return missing, err
+}
+
+// sweepMissing drops the entries of peers that stopped syncing, whose cookies have expired by now. It looks at most
+// once per cookie lifetime.
+func (s *Server) sweepMissing(now time.Time) {
+	next := s.nextSweep.Load()
+	if now.Unix() < next || !s.nextSweep.CompareAndSwap(next, now.Add(s.Cookies.ttl).Unix()) {
+		return
+	}
+	s.missing.Range(func(key, value any) bool {
+		if entry := value.(*missingEntry); entry.expires.Load() < now.Unix() {
+			s.missing.CompareAndDelete(key, entry)
+		}
+		return true
+	})
+}
+
+// Round opens the cookie in the request, applies the incoming messages to the doc, and builds the response. Errors
+// wrapping ErrInvalidCookie mean the client must restart the sync, errors wrapping ErrBadMessage mean the request was
+// invalid. The caller should persist the doc if its heads changed.
+//
+// A read-only peer may hold changes that it made before it learned its role. Its round runs on a fork of the doc that
+// takes them, so that it still receives what it is missing, and the doc is left unchanged. Its changes are carried to
+// the next round in the cookie, since the sync state there says that the server has them.
+func (s *Server) Round(store string, doc *automerge.Doc, req SyncRequest, readOnly bool, now time.Time) (*SyncResponse, error) {
+	shared := doc
+	if readOnly {
+		var err error
+		if doc, err = doc.Fork(); err != nil {
+			return nil, fmt.Errorf("failed to fork doc: %w", err)
+		}
+	}
+	var syncState *automerge.SyncState
+	if req.Cookie == nil {
+		syncState = automerge.NewSyncState(doc)
+	} else {
+		rawState, held, err := s.Cookies.Open(store, req.Peer, req.Cookie, now)
+		if err != nil {
+			return nil, err
+		}
+		if readOnly && len(held) > 0 {
+			if err := doc.LoadIncremental(held); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidCookie, err)
+			}
+		}
+		if syncState, err = automerge.LoadSyncState(doc, rawState); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCookie, err)
+		}
+	}
+
+	if _, err := ReceiveMessages(syncState, req.Messages); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadMessage, err)
+	}
+
+	peerHeads, err := changehash.Decode(req.Heads)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadMessage, err)
+	}
+	missing, err := s.countMissing(store, doc, req, peerHeads, now)
+	if err != nil {
+		return nil, err
+	}
+
+	maxBytes := s.MaxRoundBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultRoundBytes
+	}
+	batch := GenerateMessages(syncState, maxBytes)
+
+	var held []byte
+	if readOnly {
+		changes, err := doc.Changes(shared.Heads()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list held changes: %w", err)
+		} else if len(changes) > 0 {
+			held = automerge.SaveChanges(changes)
+		}
+	}
+	cookie, err := s.Cookies.Seal(store, req.Peer, syncState.Save(), held, now)
+	if err != nil {
+		return nil, err
+	}
+	out := &SyncResponse{
+		Cookie:   cookie,
+		Heads:    changehash.Encode(doc.Heads()),
+		Messages: batch.Messages,
+		More:     batch.More,
+		Missing:  missing,
+	}
+	if readOnly {
+		out.StoreHeads = changehash.Encode(shared.Heads())
+	}
+	return out, nil
+}
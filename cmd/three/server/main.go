@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -10,10 +12,16 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/automerge/automerge-go"
 	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/astromechza/automerge-experiments/cmd/three/pkg"
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+	"github.com/astromechza/automerge-experiments/pkg/identity"
 )
 
 func main() {
@@ -25,6 +33,24 @@ func main() {
 
 func mainInner() error {
 	addrVar := flag.String("addr", "localhost:8080", "the address to listen on")
+	cookieKeyVar := flag.String("cookie-key", "", "hex encoded key used to sign sync cookies, a random key is used if empty")
+	cookieTtlVar := flag.Duration("cookie-ttl", time.Minute*10, "how long an issued sync cookie remains valid")
+	roundBytesVar := flag.Int("round-bytes", pkg.DefaultRoundBytes, "the maximum size of the messages sent in each sync round")
+	issueTokenVar := flag.String("issue-token", "", "issue a token for the given subject, print it, and exit")
+	tokenTtlVar := flag.Duration("token-ttl", time.Hour*24*30, "how long an issued token remains valid, 0 for no expiry")
+	revokeTokenVar := flag.String("revoke-token", "", "revoke the token with the given id and exit")
+	grantVar := flag.String("grant", "", "grant a role on a store in the form <store>:<subject>:<role> and exit")
+	requireSignaturesVar := flag.Bool("require-signatures", false, "reject changes that are not signed by their actor's device key")
+	flag.Parse()
+
+	cookieKey, err := hex.DecodeString(*cookieKeyVar)
+	if err != nil {
+		return fmt.Errorf("failed to decode cookie key: %w", err)
+	}
+	cookies, err := pkg.NewCookieSigner(cookieKey, *cookieTtlVar)
+	if err != nil {
+		return err
+	}
 
 	slog.Info("Opening database")
 	db, err := sql.Open("sqlite3", "database.sqlite3")
@@ -33,22 +59,49 @@ func mainInner() error {
 	}
 	defer db.Close()
 
-	s := &server{database: db}
+	s := &server{
+		database:   db,
+		syncServer: &pkg.Server{Cookies: cookies, MaxRoundBytes: *roundBytesVar},
+		notifier:   pkg.NewNotifier(),
+		roles:      auth.NewRoleStore(db),
+
+		signatures:        identity.NewSignatureStore(db),
+		requireSignatures: *requireSignaturesVar,
+	}
 
 	if err := s.init(); err != nil {
 		panic(err)
 	}
 
+	tokens := auth.NewTokenStore(db)
+	if err := tokens.Init(); err != nil {
+		return err
+	}
+	if *issueTokenVar != "" {
+		token, err := tokens.Issue(context.Background(), *issueTokenVar, *tokenTtlVar)
+		if err != nil {
+			return err
+		}
+		fmt.Println(token)
+		return nil
+	} else if *revokeTokenVar != "" {
+		return tokens.Revoke(context.Background(), *revokeTokenVar)
+	} else if *grantVar != "" {
+		return s.roles.GrantSpec(context.Background(), *grantVar)
+	}
+
 	handlerWrapper := func(next http.HandlerFunc) http.HandlerFunc {
+		authenticated := tokens.Middleware(next)
 		return func(writer http.ResponseWriter, request *http.Request) {
 			rw := &recordingWriter{inner: writer}
-			next.ServeHTTP(rw, request)
+			authenticated.ServeHTTP(rw, request)
 			slog.Info("handled", "method", request.Method, "url", request.URL.String(), "status", rw.statusCode)
 		}
 	}
 	http.DefaultServeMux.HandleFunc("/get", handlerWrapper(s.getCurrent))
 	http.DefaultServeMux.HandleFunc("/new", handlerWrapper(s.createNew))
 	http.DefaultServeMux.HandleFunc("/sync", handlerWrapper(s.sync))
+	http.DefaultServeMux.HandleFunc("/watch", handlerWrapper(s.watch))
 
 	if err := http.ListenAndServe(*addrVar, http.DefaultServeMux); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		return err
@@ -78,7 +131,13 @@ func (r *recordingWriter) WriteHeader(statusCode int) {
 }
 
 type server struct {
-	database *sql.DB
+	database   *sql.DB
+	syncServer *pkg.Server
+	notifier   *pkg.Notifier
+	roles      *auth.RoleStore
+
+	signatures        *identity.SignatureStore
+	requireSignatures bool
 }
 
 func (s *server) init() error {
@@ -100,14 +159,39 @@ func (s *server) init() error {
 	); err != nil {
 		return err
 	}
+	if err := s.roles.Init(); err != nil {
+		return err
+	}
+	if err := s.signatures.Init(); err != nil {
+		return err
+	}
 	return nil
 }
 
+// authorize returns the role of the authenticated subject on the store, or writes an error response and returns false.
+func (s *server) authorize(writer http.ResponseWriter, request *http.Request) (auth.Role, bool) {
+	role, err := s.roles.RoleOfRequest(request.Context(), "default")
+	if err != nil {
+		if errors.Is(err, auth.ErrNoAccess) {
+			writer.WriteHeader(http.StatusForbidden)
+		} else {
+			slog.Error("failed to lookup role", "err", err)
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+		return "", false
+	}
+	writer.Header().Set(auth.RoleHeader, string(role))
+	return role, true
+}
+
 func (s *server) getCurrent(writer http.ResponseWriter, request *http.Request) {
 	if request.Method != http.MethodGet {
 		writer.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	if _, ok := s.authorize(writer, request); !ok {
+		return
+	}
 
 	var rawContent string
 	if err := s.database.QueryRowContext(
@@ -145,6 +229,12 @@ func (s *server) createNew(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
+	if role, ok := s.authorize(writer, request); !ok {
+		return
+	} else if !role.CanWrite() {
+		writer.WriteHeader(http.StatusForbidden)
+		return
+	}
 	var inputs struct {
 		Content []byte `json:"content"`
 	}
@@ -196,18 +286,18 @@ func (s *server) sync(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
-
-	var inputs struct {
-		Cookie   []byte   `json:"cookie"`
-		Messages [][]byte `json:"messages"`
+	role, ok := s.authorize(writer, request)
+	if !ok {
+		return
 	}
+
+	var inputs pkg.SyncRequest
 	if err := json.NewDecoder(request.Body).Decode(&inputs); err != nil {
 		slog.Error("failed to decode body", "err", err)
 		writer.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	slog.Info("opening tx")
 	tx, err := s.database.BeginTx(request.Context(), &sql.TxOptions{})
 	if err != nil {
 		slog.Error("failed to start tx", "err", err)
@@ -219,111 +309,75 @@ func (s *server) sync(writer http.ResponseWriter, request *http.Request) {
 			slog.Error("failed to rollback", "err", err)
 		}
 	}()
-	slog.Info("got tx")
 
-	var doc *automerge.Doc
-	var ss *automerge.SyncState
-	outputMessages := make([][]byte, 0)
-
-	if inputs.Cookie == nil {
-		if len(inputs.Messages) > 0 {
-			slog.Error("rejecting sync with messages without cookie", "err", err)
-			writer.WriteHeader(http.StatusBadRequest)
+	var rawContent string
+	if err := tx.QueryRowContext(
+		request.Context(),
+		`SELECT content FROM snapshots sn INNER JOIN stores st ON sn.id = st.snapshot_id WHERE st.id = ?`,
+		"default",
+	).Scan(&rawContent); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writer.WriteHeader(http.StatusNotFound)
 			return
 		}
+		slog.Error("failed to query", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	decodedContent, err := base64.StdEncoding.DecodeString(rawContent)
+	if err != nil {
+		slog.Error("failed to decode", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	doc, err := automerge.Load(decodedContent)
+	if err != nil {
+		slog.Error("failed to read the doc", "err", err)
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	initialHeads := changehash.Encode(doc.Heads())
 
-		var rawContent string
-		if err := tx.QueryRowContext(
-			request.Context(),
-			`SELECT content FROM snapshots sn INNER JOIN stores st ON sn.id = st.snapshot_id WHERE st.id = ?`,
-			"default",
-		).Scan(&rawContent); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writer.WriteHeader(http.StatusNotFound)
-				return
-			}
-			slog.Error("failed to query", "err", err)
+	// a reader's round runs on a throwaway fork, like the session fork of the websocket server, so that any changes it
+	// still holds are kept out of the store without refusing the round and leaving it without the changes it is missing
+	output, err := s.syncServer.Round("default", doc, inputs, !role.CanWrite(), time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, pkg.ErrInvalidCookie):
+			// The client must drop its cookie and sync state and start again from an empty cookie.
+			slog.Error("rejecting sync cookie", "peer", inputs.Peer, "err", err)
+			writer.WriteHeader(http.StatusPreconditionFailed)
+		case errors.Is(err, pkg.ErrBadMessage):
+			slog.Error("rejecting sync messages", "peer", inputs.Peer, "err", err)
+			writer.WriteHeader(http.StatusBadRequest)
+		default:
+			slog.Error("failed to sync", "err", err)
 			writer.WriteHeader(http.StatusInternalServerError)
-			return
-		} else {
-			decodedContent, err := base64.StdEncoding.DecodeString(rawContent)
-			if err != nil {
-				slog.Error("failed to decode", "err", err)
-				writer.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			if doc, err = automerge.Load(decodedContent); err != nil {
-				slog.Error("failed to load content", "err", err)
-				writer.WriteHeader(http.StatusInternalServerError)
-				return
-			}
 		}
-		ss = automerge.NewSyncState(doc)
-
-	} else {
+		return
+	}
+	slog.Info("sync round", "peer", inputs.Peer, "received", len(inputs.Messages), "sent", len(output.Messages), "more", output.More, "heads", output.Heads)
 
-		slog.Info("loading latest snapshot")
-		var rawContent string
-		if err := tx.QueryRowContext(
-			request.Context(),
-			`SELECT content FROM snapshots sn INNER JOIN stores st ON sn.id = st.snapshot_id WHERE st.id = ?`,
-			"default",
-		).Scan(&rawContent); err != nil {
-			slog.Error("failed to query", "err", err)
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		slog.Info("decoding latest snapshot", "d#oc", len(rawContent))
-		decodedContent, err := base64.StdEncoding.DecodeString(rawContent)
+	var verifiedSignatures []identity.Signature
+	if !pkg.SameHeads(initialHeads, changehash.Encode(doc.Heads())) {
+		since, _ := changehash.Decode(initialHeads)
+		changes, err := doc.Changes(since...)
 		if err != nil {
-			slog.Error("failed to decode", "err", err)
+			slog.Error("failed to list new changes", "err", err)
 			writer.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-
-		doc, err = automerge.Load(decodedContent)
-		if err != nil {
-			slog.Error("failed to read the doc", "err", err)
-			writer.WriteHeader(http.StatusInternalServerError)
-			return
+		signatures := make(map[string]identity.Signature, len(inputs.Signatures))
+		for _, sig := range inputs.Signatures {
+			signatures[sig.Hash] = sig
 		}
-
-		ss, err = automerge.LoadSyncState(doc, inputs.Cookie)
-		if err != nil {
-			slog.Error("failed to load the cookie", "err", err)
-			writer.WriteHeader(http.StatusInternalServerError)
+		if verifiedSignatures, err = identity.VerifyChanges(changes, signatures, s.requireSignatures, nil); err != nil {
+			slog.Error("rejecting changes with bad signatures", "peer", inputs.Peer, "err", err)
+			writer.WriteHeader(http.StatusUnprocessableEntity)
+			_, _ = writer.Write([]byte(err.Error()))
 			return
 		}
 
-		slog.Info("generating messages")
-		for i := 0; i < 100; i++ {
-			msg, valid := ss.GenerateMessage()
-			if !valid {
-				break
-			}
-			outputMessages = append(outputMessages, msg.Bytes())
-		}
-		slog.Info("reciving messages")
-		for _, message := range inputs.Messages {
-			if _, err := ss.ReceiveMessage(message); err != nil {
-				slog.Error("failed to apply a message", "err", err)
-				writer.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-		}
-
-		slog.Info("generating messages")
-		for i := 0; i < 100; i++ {
-			msg, valid := ss.GenerateMessage()
-			if !valid {
-				break
-			}
-			outputMessages = append(outputMessages, msg.Bytes())
-		}
-		slog.Info("generated messages", "m", len(outputMessages))
-
-		slog.Info("doc heads", "heads", doc.Heads(), "map", doc.RootMap().GoString())
-
 		snapShotId := fmt.Sprintf("%d", time.Now().UnixNano())
 
 		finalState := base64.StdEncoding.EncodeToString(doc.Save())
@@ -356,23 +410,97 @@ func (s *server) sync(writer http.ResponseWriter, request *http.Request) {
 			return
 		}
 
-		slog.Info("committing")
 		if err := tx.Commit(); err != nil {
 			slog.Error("failed to commit", "err", err)
 			writer.WriteHeader(http.StatusInternalServerError)
 			return
 		}
-		slog.Info("committed tx")
+		s.notifier.Notify("default")
 
+		// sqlite only allows one writer at a time, so these are stored after the commit
+		if err := s.signatures.Put(request.Context(), "default", verifiedSignatures); err != nil {
+			slog.Error("failed to store signatures", "err", err)
+		}
 	}
 
-	finalCookie := ss.Save()
-	if err := json.NewEncoder(writer).Encode(map[string]interface{}{
-		"cookie":   finalCookie,
-		"messages": outputMessages,
-	}); err != nil {
+	if err := json.NewEncoder(writer).Encode(output); err != nil {
 		slog.Error("failed to encode response", "err", err)
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
+
+func (s *server) watch(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.authorize(writer, request); !ok {
+		return
+	}
+
+	knownHeads := make([]string, 0)
+	if raw := request.URL.Query().Get("heads"); raw != "" {
+		knownHeads = strings.Split(raw, ",")
+	}
+	timeout := pkg.DefaultWatchTimeout
+	if raw := request.URL.Query().Get("timeout"); raw != "" {
+		var err error
+		if timeout, err = time.ParseDuration(raw); err != nil || timeout <= 0 {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		} else if timeout > pkg.MaxWatchTimeout {
+			timeout = pkg.MaxWatchTimeout
+		}
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	for {
+		// grab the channel before reading the heads so that we can't miss a change that lands in between
+		changed := s.notifier.Wait("default")
+
+		var rawContent string
+		if err := s.database.QueryRowContext(
+			request.Context(),
+			`SELECT content FROM snapshots sn INNER JOIN stores st ON sn.id = st.snapshot_id WHERE st.id = ?`,
+			"default",
+		).Scan(&rawContent); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				writer.WriteHeader(http.StatusNotFound)
+				return
+			}
+			slog.Error("failed to query", "err", err)
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		decodedContent, err := base64.StdEncoding.DecodeString(rawContent)
+		if err != nil {
+			slog.Error("failed to decode", "err", err)
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		doc, err := automerge.Load(decodedContent)
+		if err != nil {
+			slog.Error("failed to read the doc", "err", err)
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if currentHeads := changehash.Encode(doc.Heads()); !pkg.SameHeads(knownHeads, currentHeads) {
+			if err := json.NewEncoder(writer).Encode(&pkg.WatchResponse{Heads: currentHeads}); err != nil {
+				slog.Error("failed to encode response", "err", err)
+			}
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-t.C:
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/batch"
+	"github.com/astromechza/automerge-experiments/pkg/richtext"
+	"github.com/astromechza/automerge-experiments/pkg/todo"
+)
+
+// command is a one-shot operation on the replica, for use from scripts and hooks. Only sync and epoch talk to the
+// server, so every other command works offline.
+type command struct {
+	usage string
+	// online commands need a token to talk to the server
+	online bool
+	run    func(ctx context.Context, c *client, args []string) error
+}
+
+var commands = map[string]command{
+	"add":    {usage: "add [-description d] [-assignee name] [-due yyyy-mm-dd] [-tag tag]... <title>", run: runAdd},
+	"ls":     {usage: "ls [-status open|done] [-assignee name] [-tag tag] [-json]", run: runList},
+	"done":   {usage: "done <id>...", run: runDone},
+	"reopen": {usage: "reopen <id>...", run: runReopen},
+	"show":   {usage: "show <id>", run: runShow},
+	"edit":   {usage: "edit <id> [-title t] [-description d] [-assignee name] [-due yyyy-mm-dd] [-tag tag]... [-untag tag]...", run: runEdit},
+	"rm":     {usage: "rm <id>...", run: runRemove},
+	"sync":   {usage: "sync", online: true, run: runSync},
+	"epoch":  {usage: "epoch", online: true, run: runEpoch},
+}
+
+func commandUsage() string {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("Usage: todo [flags] [command]\n\nWithout a command, todo opens the interactive list. Commands:\n")
+	for _, name := range names {
+		b.WriteString("  todo " + commands[name].usage + "\n")
+	}
+	b.WriteString("\nIds may be shortened to any unique prefix. Flags:\n")
+	return b.String()
+}
+
+// listFlag collects a flag that may be repeated.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func parseDue(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	due, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return nil, fmt.Errorf("invalid due date %q, expected yyyy-mm-dd", s)
+	}
+	return &due, nil
+}
+
+// resolveID finds the task that the id or id prefix refers to.
+func resolveID(doc *automerge.Doc, prefix string) (string, error) {
+	tasks, err := todo.Query(doc, todo.Filter{})
+	if err != nil {
+		return "", err
+	}
+	matches := make([]string, 0, 1)
+	for _, t := range tasks {
+		if t.ID == prefix {
+			return t.ID, nil
+		} else if strings.HasPrefix(t.ID, prefix) {
+			matches = append(matches, t.ID)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", todo.ErrNotFound, prefix)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("id %s is ambiguous, it matches %s", prefix, strings.Join(matches, ", "))
+}
+
+// formatTask renders the task on a single line, without its id.
+func formatTask(t todo.Task) string {
+	box := "[ ]"
+	if t.Status == todo.StatusDone {
+		box = "[x]"
+	}
+	text := box + " " + t.Title
+	if t.Assignee != "" {
+		text += "  @" + t.Assignee
+	}
+	if t.Due != nil {
+		text += "  due " + t.Due.Format(time.DateOnly)
+	}
+	for _, tag := range t.Tags {
+		text += "  #" + tag
+	}
+	return text
+}
+
+func runAdd(_ context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("add", flag.ExitOnError)
+	description := fs.String("description", "", "a longer description of the task")
+	assignee := fs.String("assignee", "", "the person to assign the task to")
+	due := fs.String("due", "", "the due date of the task")
+	var tags listFlag
+	fs.Var(&tags, "tag", "a tag for the task, may be repeated")
+	_ = fs.Parse(args)
+
+	nt := todo.NewTask{Title: strings.Join(fs.Args(), " "), Description: *description, Assignee: *assignee, Tags: tags}
+	var err error
+	if nt.Due, err = parseDue(*due); err != nil {
+		return err
+	}
+	var id string
+	if err := c.edit(func(doc *automerge.Doc) (string, error) {
+		var msg string
+		id, msg, err = todo.Add(doc, nt)
+		return msg, err
+	}); err != nil {
+		return err
+	}
+	fmt.Println(id)
+	return nil
+}
+
+func runList(_ context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("ls", flag.ExitOnError)
+	status := fs.String("status", "", "only list tasks with this status: open or done")
+	assignee := fs.String("assignee", "", "only list tasks assigned to this person")
+	tag := fs.String("tag", "", "only list tasks with this tag")
+	asJson := fs.Bool("json", false, "print the tasks as a json array")
+	_ = fs.Parse(args)
+
+	tasks, err := todo.Query(c.doc, todo.Filter{Status: *status, Assignee: *assignee, Tag: *tag})
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(tasks)
+	}
+	for _, t := range tasks {
+		fmt.Println(t.ID + "  " + formatTask(t))
+	}
+	return nil
+}
+
+// forEachID runs the operation on each task named in the arguments.
+func forEachID(c *client, args []string, op func(doc *automerge.Doc, id string) (string, error)) error {
+	if len(args) == 0 {
+		return fmt.Errorf("at least one task id is required")
+	}
+	return c.edit(func(doc *automerge.Doc) (string, error) {
+		var messages []string
+		for _, prefix := range args {
+			id, err := resolveID(doc, prefix)
+			if err != nil {
+				return "", err
+			}
+			if msg, err := op(doc, id); err != nil {
+				return "", err
+			} else if msg != "" {
+				messages = append(messages, msg)
+			}
+		}
+		return joinMessages(messages), nil
+	})
+}
+
+// joinMessages summarises the messages of several operations made in one edit, see batch.Message.
+func joinMessages(messages []string) string {
+	if len(messages) == 0 {
+		return ""
+	}
+	return batch.Message(messages)
+}
+
+func runShow(_ context.Context, c *client, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("exactly one task id is required")
+	}
+	id, err := resolveID(c.doc, args[0])
+	if err != nil {
+		return err
+	}
+	t, err := todo.Get(c.doc, id)
+	if err != nil {
+		return err
+	}
+	spans, err := todo.DescriptionSpans(c.doc, id)
+	if err != nil {
+		return err
+	}
+	fmt.Println(t.ID + "  " + formatTask(t))
+	if !t.UpdatedAt.IsZero() {
+		fmt.Println("updated " + t.UpdatedAt.Time().Format(time.DateTime))
+	}
+	if t.Description != "" {
+		fmt.Println()
+		fmt.Println(richtext.Markdown(t.Description, spans))
+	}
+	return nil
+}
+
+func runDone(_ context.Context, c *client, args []string) error {
+	return forEachID(c, args, todo.Complete)
+}
+
+func runReopen(_ context.Context, c *client, args []string) error {
+	return forEachID(c, args, todo.Reopen)
+}
+
+func runRemove(_ context.Context, c *client, args []string) error {
+	return forEachID(c, args, todo.Delete)
+}
+
+func runEdit(_ context.Context, c *client, args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	title := fs.String("title", "", "the new title")
+	description := fs.String("description", "", "the new description")
+	assignee := fs.String("assignee", "", "the new assignee, empty to unassign")
+	due := fs.String("due", "", "the new due date, empty to clear it")
+	var tags, untags listFlag
+	fs.Var(&tags, "tag", "a tag to add, may be repeated")
+	fs.Var(&untags, "untag", "a tag to remove, may be repeated")
+
+	// the id may come before or after the flags
+	prefix := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		prefix, args = args[0], args[1:]
+	}
+	_ = fs.Parse(args)
+	if prefix == "" {
+		prefix = fs.Arg(0)
+	}
+	if prefix == "" {
+		return fmt.Errorf("a task id is required")
+	}
+	id, err := resolveID(c.doc, prefix)
+	if err != nil {
+		return err
+	}
+
+	// only the fields that were given are changed, so that unrelated concurrent edits are kept
+	var ops []func(doc *automerge.Doc) (string, error)
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "title":
+			ops = append(ops, func(doc *automerge.Doc) (string, error) { return todo.Rename(doc, id, *title) })
+		case "description":
+			ops = append(ops, func(doc *automerge.Doc) (string, error) { return todo.SetDescription(doc, id, *description) })
+		case "assignee":
+			ops = append(ops, func(doc *automerge.Doc) (string, error) { return todo.Assign(doc, id, *assignee) })
+		case "due":
+			ops = append(ops, func(doc *automerge.Doc) (string, error) {
+				d, err := parseDue(*due)
+				if err != nil {
+					return "", err
+				}
+				return todo.SetDue(doc, id, d)
+			})
+		}
+	})
+	for _, tag := range tags {
+		tag := tag
+		ops = append(ops, func(doc *automerge.Doc) (string, error) { return todo.Tag(doc, id, tag) })
+	}
+	for _, tag := range untags {
+		tag := tag
+		ops = append(ops, func(doc *automerge.Doc) (string, error) { return todo.Untag(doc, id, tag) })
+	}
+	if len(ops) == 0 {
+		return fmt.Errorf("nothing to edit, pass at least one of the flags")
+	}
+	// the edits are committed together as one batch
+	return c.edit(func(doc *automerge.Doc) (string, error) {
+		var messages []string
+		for _, op := range ops {
+			if msg, err := op(doc); err != nil {
+				return "", err
+			} else if msg != "" {
+				messages = append(messages, msg)
+			}
+		}
+		return joinMessages(messages), nil
+	})
+}
+
+func runSync(ctx context.Context, c *client, _ []string) error {
+	before, err := c.doc.Changes()
+	if err != nil {
+		return fmt.Errorf("failed to list changes: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	exchange := c.syncOnce
+	if c.docKey != nil {
+		exchange = c.relayOnce
+	}
+	if err := exchange(ctx); err != nil {
+		return fmt.Errorf("failed to sync: %w", err)
+	}
+	after, err := c.doc.Changes()
+	if err != nil {
+		return fmt.Errorf("failed to list changes: %w", err)
+	}
+	pulled := len(after) - len(before)
+
+	// the pulled changes may conflict with ours, and the resolution needs to reach the server too
+	resolved, err := todo.ResolveConflicts(c.doc)
+	if err != nil {
+		return err
+	}
+	if len(resolved) > 0 {
+		fmt.Printf("resolved conflicts at %s\n", strings.Join(resolved, ", "))
+		if err := exchange(ctx); err != nil {
+			return fmt.Errorf("failed to sync resolution: %w", err)
+		}
+	}
+
+	tasks, err := todo.Query(c.doc, todo.Filter{})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("synced %s: pulled %d changes, %d tasks\n", c.store, pulled, len(tasks))
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+	"github.com/astromechza/automerge-experiments/pkg/epoch"
+	"github.com/astromechza/automerge-experiments/pkg/todo"
+)
+
+// fetch gets a resource of the store from the server.
+func fetch(ctx context.Context, token string, u *url.URL) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := auth.NewClient(token).Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", u.Path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from %s: %d", u.Path, resp.StatusCode)
+	}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", u.Path, err)
+	}
+	return raw, nil
+}
+
+// moveToCurrentEpoch returns the doc of the store's current epoch if the server has started a new one since the
+// replica last synced, with the local edits that the server never received carried over to it. If the server can't be
+// reached it returns the doc as it is, and the sync will find out about the epoch instead.
+func moveToCurrentEpoch(ctx context.Context, baseUrl *url.URL, store, token string, doc *automerge.Doc) (*automerge.Doc, error) {
+	local, err := epoch.Of(doc)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := fetch(ctx, token, baseUrl.JoinPath("stores", store, "epoch"))
+	if err != nil {
+		slog.Warn("failed to check the epoch of the store", "err", err)
+		return doc, nil
+	}
+	var current epoch.Info
+	if err := json.Unmarshal(raw, &current); err != nil {
+		return nil, fmt.Errorf("failed to decode epoch: %w", err)
+	} else if current.Number == local.Number {
+		return doc, nil
+	} else if current.Number < local.Number {
+		return nil, fmt.Errorf("the replica is from epoch %d but the store is only at epoch %d", local.Number, current.Number)
+	}
+
+	if raw, err = fetch(ctx, token, baseUrl.JoinPath("stores", store, "latest")); err != nil {
+		return nil, err
+	}
+	next, err := automerge.Load(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load epoch %d: %w", current.Number, err)
+	}
+	if err := next.SetActorID(doc.ActorID()); err != nil {
+		return nil, fmt.Errorf("failed to set actor id: %w", err)
+	}
+	// a replica that has only ever received changes, such as a new one, has nothing to carry over
+	if !epoch.Has(next, doc.Heads()) {
+		if raw, err = fetch(ctx, token, baseUrl.JoinPath("stores", store, "epochs", strconv.Itoa(local.Number))); err != nil {
+			return nil, err
+		}
+		archive, err := automerge.Load(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load archive of epoch %d: %w", local.Number, err)
+		}
+		paths, err := todo.Forward(next, archive, doc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to carry changes forward: %w", err)
+		}
+		slog.Info("carried changes forward", "from", local.Number, "to", current.Number, "paths", paths)
+	}
+	slog.Info("moved to new epoch", "from", local.Number, "to", current.Number, "heads", next.Heads())
+	return next, nil
+}
+
+// runEpoch starts a new epoch of the store, which compacts its history. Every replica, including this one, moves to it
+// the next time it syncs.
+func runEpoch(ctx context.Context, c *client, _ []string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseUrl.JoinPath("stores", c.store, "epochs").String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := auth.NewClient(c.token).Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to start epoch: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden:
+		return fmt.Errorf("only owners of the store can start an epoch")
+	default:
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	var info epoch.Info
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return fmt.Errorf("failed to decode epoch: %w", err)
+	}
+	fmt.Printf("started epoch %d of %s, replicas move to it when they next sync\n", info.Number, c.store)
+	return nil
+}
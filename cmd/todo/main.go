@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/cmd/four/pkg"
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+	"github.com/astromechza/automerge-experiments/pkg/batch"
+	"github.com/astromechza/automerge-experiments/pkg/handle"
+	"github.com/astromechza/automerge-experiments/pkg/identity"
+	"github.com/astromechza/automerge-experiments/pkg/todo"
+)
+
+func main() {
+	if err := mainInner(); err != nil {
+		// logs go to a file, so errors are printed directly
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func mainInner() error {
+	addrVar := flag.String("addr", "127.0.0.1:8080", "the address of the cmd/four server")
+	storeVar := flag.String("store", "default", "the store holding the todo list")
+	tokenVar := flag.String("token", "", "the bearer token to authenticate with, defaults to $"+auth.TokenEnvVar)
+	tokenFileVar := flag.String("token-file", "", "a file containing the bearer token to authenticate with")
+	identityVar := flag.String("identity", "", "the device key file, created if it does not exist, defaults to one in the user config dir")
+	nameVar := flag.String("name", "", "a display name for this device, recorded in the doc so that its changes can be attributed")
+	replicaVar := flag.String("replica", "", "the local copy of the todo list, defaults to one per store in the user config dir")
+	docKeyVar := flag.String("doc-key", "", "a hex encoded 32 byte key, when set the sync command exchanges encrypted changes with a relay server")
+	docKeyFileVar := flag.String("doc-key-file", "", "a file containing the hex encoded doc key")
+	batchWindowVar := flag.Duration("batch-window", batch.DefaultWindow, "how long edits are gathered into one commit before it is synced")
+	logVar := flag.String("log", filepath.Join(os.TempDir(), "todo.log"), "the file to write logs to, since the terminal is taken by the ui")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), commandUsage())
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	var cmd *command
+	if flag.NArg() > 0 {
+		c, ok := commands[flag.Arg(0)]
+		if !ok {
+			flag.Usage()
+			return fmt.Errorf("unknown command %q", flag.Arg(0))
+		}
+		cmd = &c
+	}
+
+	logFile, err := os.OpenFile(*logVar, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	defer logFile.Close()
+	slog.SetDefault(slog.New(slog.NewTextHandler(logFile, &slog.HandlerOptions{})))
+
+	baseUrl, err := url.Parse("http://" + *addrVar)
+	if err != nil {
+		return err
+	}
+	var token string
+	if cmd == nil || cmd.online {
+		if token, err = auth.ResolveToken(*tokenVar, *tokenFileVar); err != nil {
+			return err
+		}
+	}
+	var docKey []byte
+	if *docKeyVar != "" || *docKeyFileVar != "" {
+		if docKey, err = pkg.LoadDocKey(*docKeyVar, *docKeyFileVar); err != nil {
+			return err
+		}
+	}
+	if *identityVar == "" {
+		if *identityVar, err = identity.DefaultPath(); err != nil {
+			return err
+		}
+	}
+	device, err := identity.LoadOrCreate(*identityVar)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+	if *replicaVar == "" {
+		if *replicaVar, err = defaultReplicaPath(*storeVar); err != nil {
+			return err
+		}
+	}
+
+	rep, doc, err := openReplica(*replicaVar)
+	if err != nil {
+		return err
+	}
+	defer rep.Close()
+	if err := doc.SetActorID(device.ActorID()); err != nil {
+		return fmt.Errorf("failed to set actor id: %w", err)
+	}
+	// the relay can't start epochs, since it never sees the doc
+	// a new key has never written a change, so only a key that was used before needs to catch up with the store
+	if len(doc.Heads()) == 0 && !device.Created() && docKey == nil {
+		if token == "" {
+			if token, err = auth.ResolveToken(*tokenVar, *tokenFileVar); err != nil {
+				return err
+			}
+		}
+		if doc, err = seedReplica(context.Background(), baseUrl, *storeVar, token, doc); err != nil {
+			return err
+		}
+	}
+	if (cmd == nil || cmd.online) && docKey == nil {
+		if doc, err = moveToCurrentEpoch(context.Background(), baseUrl, *storeVar, token, doc); err != nil {
+			return err
+		} else if err := rep.Save(doc); err != nil {
+			return err
+		}
+	}
+	if err := todo.Init(doc); err != nil {
+		return fmt.Errorf("failed to open todo list: %w", err)
+	}
+	if msg, err := identity.SetName(doc, device.ActorID(), *nameVar); err != nil {
+		return err
+	} else if msg != "" {
+		if err := todo.Commit(doc, msg); err != nil {
+			return err
+		}
+	}
+	// the replica may hold changes from other devices with clocks ahead of this one
+	if err := todo.Observe(doc); err != nil {
+		slog.Warn("failed to observe changes", "err", err)
+	}
+	docHandle, err := handle.New(doc)
+	if err != nil {
+		return err
+	}
+	c := &client{
+		baseUrl: baseUrl, store: *storeVar, token: token, device: device, docKey: docKey, doc: doc,
+		docHandle:       docHandle,
+		history:         todo.NewHistory(),
+		batch:           batch.New(doc, docHandle),
+		presence:        pkg.Presence{Actor: device.ActorID()},
+		presenceChanged: make(chan struct{}, 1),
+		peers:           make(map[string]peerPresence),
+	}
+
+	c.batch.Window = *batchWindowVar
+	c.batch.Commit = todo.CommitBatch
+	c.batch.OnFlush = c.history.Record
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if cmd != nil {
+		err = cmd.run(ctx, c, flag.Args()[1:])
+	} else {
+		err = runInteractive(ctx, c, rep)
+	}
+	// whatever succeeded before an error is still worth keeping
+	if flushErr := c.batch.Flush(); flushErr != nil {
+		err = errors.Join(err, flushErr)
+	}
+	if saveErr := c.read(rep.Save); saveErr != nil {
+		return errors.Join(err, saveErr)
+	}
+	return err
+}
+
+// runInteractive runs the ui while syncing in the background. In the background it also resolves conflicts that the
+// sync brings in, and saves the replica as it changes so that little is lost if the process dies.
+func runInteractive(ctx context.Context, c *client, rep *replica) error {
+	if c.docKey != nil {
+		return fmt.Errorf("the interactive list does not support the relay yet, use the sync command instead")
+	}
+	go c.syncContinuously(ctx)
+	go func() {
+		t := time.NewTicker(time.Second * 5)
+		defer t.Stop()
+		var checked []automerge.ChangeHash
+		for {
+			select {
+			case <-t.C:
+				checked = c.resolveConflicts(checked)
+				if err := c.read(rep.Save); err != nil {
+					slog.Error("failed to save replica", "err", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if err := runUI(ctx, c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+
+	"github.com/automerge/automerge-go"
+)
+
+// replica is the local copy of the todo list. Edits are made to it offline and exchanged with the server by syncing.
+type replica struct {
+	path  string
+	lock  *os.File
+	saved []automerge.ChangeHash
+}
+
+// defaultReplicaPath keeps a replica per store next to the device key.
+func defaultReplicaPath(store string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find config dir: %w", err)
+	}
+	return filepath.Join(dir, "automerge-experiments", "todo-"+store+".automerge"), nil
+}
+
+// openReplica locks the replica and loads the doc from it, or returns an empty doc if it does not exist yet. The lock
+// stops two processes from writing changes as the same actor, which would give two different changes the same sequence
+// number.
+func openReplica(path string) (*replica, *automerge.Doc, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create replica dir: %w", err)
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open replica lock: %w", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = lock.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, nil, fmt.Errorf("replica %s is in use by another todo process", path)
+		}
+		return nil, nil, fmt.Errorf("failed to lock replica: %w", err)
+	}
+	r := &replica{path: path, lock: lock}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return r, automerge.New(), nil
+	} else if err != nil {
+		_ = r.Close()
+		return nil, nil, fmt.Errorf("failed to read replica: %w", err)
+	}
+	doc, err := automerge.Load(raw)
+	if err != nil {
+		_ = r.Close()
+		return nil, nil, fmt.Errorf("failed to load replica: %w", err)
+	}
+	r.saved = doc.Heads()
+	return r, doc, nil
+}
+
+// Save writes the doc if it has changed since it was last saved. The file is replaced atomically so that a crash
+// leaves either the old or the new replica.
+func (r *replica) Save(doc *automerge.Doc) error {
+	heads := doc.Heads()
+	if r.saved != nil && slices.Equal(heads, r.saved) {
+		return nil
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, doc.Save(), 0o600); err != nil {
+		return fmt.Errorf("failed to write replica: %w", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("failed to replace replica: %w", err)
+	}
+	r.saved = heads
+	return nil
+}
+
+func (r *replica) Close() error {
+	return r.lock.Close()
+}
+
+// seedReplica returns the server's copy of the store for a replica that holds no changes yet. The device may already
+// have written changes to the store from another replica, and a replica that started empty would write its first
+// change with a sequence number the server already holds, which the server then refuses to merge.
+func seedReplica(ctx context.Context, baseUrl *url.URL, store, token string, doc *automerge.Doc) (*automerge.Doc, error) {
+	raw, err := fetch(ctx, token, baseUrl.JoinPath("stores", store, "latest"))
+	if err != nil {
+		return nil, fmt.Errorf("the replica is new and the device key has been used before, so it has to get the store from the server once before it is used offline: %w", err)
+	}
+	latest, err := automerge.Load(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load store: %w", err)
+	}
+	if err := latest.SetActorID(doc.ActorID()); err != nil {
+		return nil, fmt.Errorf("failed to set actor id: %w", err)
+	}
+	slog.Info("seeded new replica", "heads", latest.Heads())
+	return latest, nil
+}
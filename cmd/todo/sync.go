@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+	"github.com/gorilla/websocket"
+
+	"github.com/astromechza/automerge-experiments/cmd/four/pkg"
+	"github.com/astromechza/automerge-experiments/pkg/auth"
+	"github.com/astromechza/automerge-experiments/pkg/batch"
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+	"github.com/astromechza/automerge-experiments/pkg/handle"
+	"github.com/astromechza/automerge-experiments/pkg/identity"
+	"github.com/astromechza/automerge-experiments/pkg/syncprogress"
+	"github.com/astromechza/automerge-experiments/pkg/todo"
+	"github.com/astromechza/automerge-experiments/pkg/undo"
+)
+
+type client struct {
+	baseUrl *url.URL
+	store   string
+	token   string
+	device  *identity.Device
+	// docKey is set when the store is only reachable through the encrypted relay
+	docKey []byte
+	doc    *automerge.Doc
+
+	// docHandle is locked by the ui for each operation and by the sync for each message, so neither sees the other's
+	// half finished work, and tells subscribers what changed
+	docHandle *handle.Handle
+	// history records the edits made through edit so that the ui can undo them
+	history *undo.Manager
+	// batch gathers the edits made through edit into fewer commits
+	batch *batch.Batcher
+
+	statusLock sync.Mutex
+	status     string
+	role       auth.Role
+	// progress is of the current connection's sync, it is reset on each connect
+	progress syncprogress.Progress
+
+	// presence is what we tell the other sessions of the store about ourselves, and peers is what they told us
+	presenceLock    sync.Mutex
+	presence        pkg.Presence
+	presenceChanged chan struct{}
+	peers           map[string]peerPresence
+}
+
+type peerPresence struct {
+	pkg.Presence
+	seen time.Time
+}
+
+const (
+	presenceInterval = time.Second * 5
+	// presenceTimeout forgets peers whose gone message was lost, such as when the server restarts
+	presenceTimeout = presenceInterval * 3
+)
+
+func (c *client) setStatus(status string, role auth.Role) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.status, c.role = status, role
+}
+
+func (c *client) Status() (string, auth.Role) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	return c.status, c.role
+}
+
+func (c *client) setProgress(p syncprogress.Progress) {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	c.progress = p
+}
+
+// Progress returns how far along the sync of the current connection is.
+func (c *client) Progress() syncprogress.Progress {
+	c.statusLock.Lock()
+	defer c.statusLock.Unlock()
+	return c.progress
+}
+
+// SetPresence updates what the other sessions see us doing, and sends it straight away if it changed.
+func (c *client) SetPresence(focus string, typing bool) {
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+	if c.presence.Focus == focus && c.presence.Typing == typing {
+		return
+	}
+	c.presence.Focus, c.presence.Typing = focus, typing
+	select {
+	case c.presenceChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Peers returns the other sessions of the store that are connected right now, ordered by who they are.
+func (c *client) Peers() []pkg.Presence {
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+	out := make([]pkg.Presence, 0, len(c.peers))
+	for id, p := range c.peers {
+		if time.Since(p.seen) > presenceTimeout {
+			delete(c.peers, id)
+			continue
+		}
+		out = append(out, p.Presence)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Session < out[j].Session
+	})
+	return out
+}
+
+func (c *client) receivePresence(p pkg.Presence) {
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+	if p.Gone {
+		delete(c.peers, p.Session)
+	} else if p.Actor != c.presence.Actor {
+		c.peers[p.Session] = peerPresence{Presence: p, seen: time.Now()}
+	}
+}
+
+// sendPresence sends our presence on a heartbeat and whenever it changes, until the context is done.
+func (c *client) sendPresence(ctx context.Context, outbox chan<- pkg.ControlMessage) {
+	t := time.NewTicker(presenceInterval)
+	defer t.Stop()
+	for {
+		c.presenceLock.Lock()
+		p := c.presence
+		c.presenceLock.Unlock()
+		select {
+		case outbox <- pkg.ControlMessage{Type: pkg.ControlTypePresence, Presence: &p}:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-t.C:
+		case <-c.presenceChanged:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *client) syncContinuously(ctx context.Context) {
+	for {
+		_, role := c.Status()
+		c.setStatus("connecting", role)
+		var epochErr *pkg.EpochError
+		var rejectedErr *pkg.RejectedError
+		if err := c.connectAndSync(ctx); errors.As(err, &epochErr) {
+			// the doc can't be swapped under the ui, the move to the new epoch happens on the next start
+			slog.Error("stopping sync", "err", err)
+			c.setStatus(fmt.Sprintf("moved to epoch %d, restart to migrate", epochErr.Epoch), role)
+			return
+		} else if errors.As(err, &rejectedErr) {
+			// the replica holds the rejected changes for good, so every sync would offer them again
+			slog.Error("stopping sync", "changes", rejectedErr.Changes, "err", err)
+			c.setStatus("stopped, the server rejected our changes", role)
+			return
+		} else if err != nil {
+			slog.Error("failed to sync", "err", err)
+			c.setStatus("offline", role)
+		} else {
+			c.setStatus("disconnected", role)
+		}
+		t := time.NewTimer(time.Second)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// connectAndSync keeps a sync connection open until it fails or the context is done.
+func (c *client) connectAndSync(ctx context.Context) error {
+	conn, resp, err := c.dialSync(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	c.setStatus("connected", auth.Role(resp.Header.Get(auth.RoleHeader)))
+	proof := c.device.ProveSession(resp.Header.Get(pkg.SessionHeader))
+	c.presenceLock.Lock()
+	c.presence.Proof = &proof
+	c.presenceLock.Unlock()
+	var tracker *syncprogress.Tracker
+	_ = c.read(func(doc *automerge.Doc) error {
+		tracker = syncprogress.NewTracker(doc, c.setProgress)
+		return nil
+	})
+	c.setProgress(tracker.Progress())
+
+	// presence only means anything while connected, the server tells the others that we've gone when we disconnect
+	presenceCtx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		c.presenceLock.Lock()
+		clear(c.peers)
+		c.presenceLock.Unlock()
+	}()
+	outbox := make(chan pkg.ControlMessage)
+	go c.sendPresence(presenceCtx, outbox)
+
+	hooks := c.syncHooks()
+	hooks.Outbox = outbox
+	hooks.Progress = tracker
+	hooks.Wake = c.batch.Flushed()
+	// the sync ends with the connection, so the epoch it was ended by is kept to return
+	var moved error
+	hooks.OnControl = func(msg pkg.ControlMessage) error {
+		switch msg.Type {
+		case pkg.ControlTypePresence:
+			if msg.Presence != nil {
+				c.receivePresence(*msg.Presence)
+			}
+		case pkg.ControlTypeEpoch:
+			moved = &pkg.EpochError{Epoch: msg.Epoch}
+			return moved
+		}
+		return nil
+	}
+	if err := pkg.Sync(ctx, conn, automerge.NewSyncState(c.doc), hooks); err != nil {
+		return err
+	}
+	return moved
+}
+
+// dialSync opens a sync connection, telling the server which epoch the doc is from.
+func (c *client) dialSync(ctx context.Context) (*websocket.Conn, *http.Response, error) {
+	u := c.baseUrl.JoinPath("stores", c.store, "sync")
+	u.Scheme = "ws"
+	var header http.Header
+	if err := c.read(func(doc *automerge.Doc) (err error) {
+		header, err = pkg.SetEpochHeader(auth.Header(c.token), doc)
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		return nil, nil, pkg.CheckDialError(resp, err)
+	}
+	return conn, resp, nil
+}
+
+func (c *client) syncHooks() *pkg.Hooks {
+	return &pkg.Hooks{
+		DocLock: c.docHandle,
+		BeforeSend: func(msg *automerge.SyncMessage, send func(pkg.ControlMessage) error) error {
+			if sigs := c.device.SignOwnChanges(msg.Changes(), todo.IsDerived); len(sigs) > 0 {
+				return send(pkg.ControlMessage{Type: pkg.ControlTypeSignatures, Signatures: sigs})
+			}
+			return nil
+		},
+		// the clock has to pass the changes before any edit that follows them is stamped
+		AfterReceive: func(msg *automerge.SyncMessage) error {
+			if err := todo.ObserveChanges(msg.Changes()); err != nil {
+				slog.Warn("failed to observe changes", "err", err)
+			}
+			return nil
+		},
+	}
+}
+
+// syncOnce pushes and pulls changes until the server and the doc agree, and then disconnects.
+func (c *client) syncOnce(ctx context.Context) error {
+	conn, _, err := c.dialSync(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the server replies on a one second tick, so wait a little longer than that before deciding it is done
+	return pkg.SyncOnce(ctx, conn, automerge.NewSyncState(c.doc), c.syncHooks(), time.Second*3)
+}
+
+// relayOnce downloads the changes the relay has that the doc lacks, uploads the changes the relay lacks, and then
+// disconnects.
+func (c *client) relayOnce(ctx context.Context) error {
+	u := c.baseUrl.JoinPath("stores", c.store, "relay")
+	u.Scheme = "ws"
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), auth.Header(c.token))
+	if err != nil {
+		return fmt.Errorf("failed to dial: %w", err)
+	}
+	defer conn.Close()
+	role := auth.Role(resp.Header.Get(auth.RoleHeader))
+
+	if err := conn.WriteJSON(pkg.RelayMessage{Type: pkg.RelayTypeHello, Heads: changehash.Encode(c.doc.Heads())}); err != nil {
+		return fmt.Errorf("failed to send hello: %w", err)
+	}
+	closing := false
+	// our own close frame has already been sent by the time the relay answers it, so there is nothing to echo
+	conn.SetCloseHandler(func(int, string) error { return nil })
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Second * 10)); err != nil {
+			return fmt.Errorf("failed to set read deadline: %w", err)
+		}
+		var msg pkg.RelayMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if closing && websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return fmt.Errorf("failed to read: %w", err)
+		}
+		switch msg.Type {
+		case pkg.RelayTypeChanges:
+			// changes from other peers may still be forwarded to us while closing
+			heads := c.doc.Heads()
+			if err := pkg.ApplyEncryptedChanges(c.docKey, c.doc, msg.Changes); err != nil {
+				return err
+			}
+			if err := todo.Observe(c.doc, heads...); err != nil {
+				slog.Warn("failed to observe changes", "err", err)
+			}
+		case pkg.RelayTypeHeads:
+			// the relay sends its heads after the changes we lacked, so everything after them is ours to upload
+			since, err := changehash.Decode(msg.Heads)
+			if err != nil {
+				return fmt.Errorf("invalid relay heads: %w", err)
+			}
+			if role == "" || role.CanWrite() {
+				sealed, err := pkg.SealChangesSince(c.docKey, c.doc, since)
+				if err != nil {
+					return err
+				} else if len(sealed) > 0 {
+					if err := conn.WriteJSON(pkg.RelayMessage{Type: pkg.RelayTypeChanges, Changes: sealed}); err != nil {
+						return fmt.Errorf("failed to send changes: %w", err)
+					}
+					slog.Info("uploaded changes", "changes", len(sealed))
+				}
+			}
+			// the relay answers the close once it has handled the changes, or reports why it refused them
+			if err := conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")); err != nil {
+				return fmt.Errorf("failed to close: %w", err)
+			}
+			closing = true
+		case pkg.RelayTypeError:
+			return fmt.Errorf("relay closed the connection: %s", msg.Error)
+		default:
+			return fmt.Errorf("unexpected relay message type %q", msg.Type)
+		}
+	}
+}
+
+// resolveConflicts applies the todo merge policies to the conflicts that the changes since the given heads take part
+// in, and returns the heads it looked at. Finding them diffs the changes that arrived since, so it runs on a fork
+// without holding the doc lock and only the resolution is merged back.
+func (c *client) resolveConflicts(checked []automerge.ChangeHash) []automerge.ChangeHash {
+	// readers can't write the resolution, they leave it to the writers
+	if _, role := c.Status(); role != "" && !role.CanWrite() {
+		return checked
+	}
+	var fork *automerge.Doc
+	if err := c.read(func(doc *automerge.Doc) error {
+		if slices.Equal(checked, doc.Heads()) {
+			return nil
+		}
+		var err error
+		fork, err = doc.Fork()
+		return err
+	}); err != nil {
+		slog.Error("failed to fork doc", "err", err)
+		return checked
+	} else if fork == nil {
+		return checked
+	}
+	heads := fork.Heads()
+	resolved, err := todo.ResolveConflicts(fork, checked...)
+	if err != nil {
+		slog.Error("failed to resolve conflicts", "err", err)
+		return checked
+	} else if len(resolved) == 0 {
+		return heads
+	}
+	// the resolution is not the user's edit, so it is merged without recording it for undo, and since it is made by
+	// its own actor it doesn't need the pending batch flushed first
+	if err := c.read(func(doc *automerge.Doc) error {
+		_, err := doc.Merge(fork)
+		return err
+	}); err != nil {
+		slog.Error("failed to merge resolved conflicts", "err", err)
+		return checked
+	}
+	slog.Info("resolved conflicts", "paths", resolved)
+	return heads
+}
+
+// edit runs the operation in the current batch, which records it in the history once it is committed. The operation
+// returns the message describing it, as the operations of package todo do.
+func (c *client) edit(op func(doc *automerge.Doc) (string, error)) error {
+	if _, role := c.Status(); role != "" && !role.CanWrite() {
+		return fmt.Errorf("the store is read only for you")
+	}
+	return c.batch.Edit(op)
+}
+
+// write commits the current batch and then runs the operation on the doc while holding the doc lock, for operations
+// that must not be batched.
+func (c *client) write(op func(doc *automerge.Doc) error) error {
+	if _, role := c.Status(); role != "" && !role.CanWrite() {
+		return fmt.Errorf("the store is read only for you")
+	}
+	if err := c.batch.Flush(); err != nil {
+		return err
+	}
+	c.docHandle.Lock()
+	defer c.docHandle.Unlock()
+	return op(c.doc)
+}
+
+// view runs the function on the doc as the user sees it, including the edits of the current batch.
+func (c *client) view(fn func(doc *automerge.Doc) error) error {
+	return c.batch.View(fn)
+}
+
+// read runs the function on the doc while holding the doc lock.
+func (c *client) read(fn func(doc *automerge.Doc) error) error {
+	c.docHandle.Lock()
+	defer c.docHandle.Unlock()
+	return fn(c.doc)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+)
+
+// stty runs stty against our terminal. It avoids a dependency for raw mode at the cost of only working on unix.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to run stty %s: %w", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// makeRaw switches the terminal to raw mode and the alternate screen, and returns a function to undo it.
+func makeRaw() (func(), error) {
+	saved, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("raw", "-echo"); err != nil {
+		return nil, err
+	}
+	fmt.Print("\x1b[?1049h\x1b[?25l")
+	return func() {
+		fmt.Print("\x1b[?25h\x1b[?1049l")
+		_, _ = stty(saved)
+	}, nil
+}
+
+// termSize returns the rows and columns of the terminal, falling back to 24x80.
+func termSize() (int, int) {
+	out, err := stty("size")
+	if err == nil {
+		var rows, cols int
+		if _, err := fmt.Sscanf(out, "%d %d", &rows, &cols); err == nil && rows > 0 && cols > 0 {
+			return rows, cols
+		}
+	}
+	return 24, 80
+}
+
+const (
+	keyUp        = "up"
+	keyDown      = "down"
+	keyEnter     = "enter"
+	keyEscape    = "esc"
+	keyBackspace = "backspace"
+	keyInterrupt = "ctrl-c"
+	keyUndo      = "ctrl-z"
+	keyRedo      = "ctrl-y"
+)
+
+// parseKeys splits a chunk read from the terminal into keys. Printable characters are returned as themselves.
+func parseKeys(p []byte) []string {
+	out := make([]string, 0, len(p))
+	for len(p) > 0 {
+		switch {
+		case len(p) >= 3 && p[0] == 0x1b && p[1] == '[':
+			switch p[2] {
+			case 'A':
+				out = append(out, keyUp)
+			case 'B':
+				out = append(out, keyDown)
+			}
+			p = p[3:]
+		case p[0] == 0x1b:
+			out = append(out, keyEscape)
+			p = p[1:]
+		case p[0] == '\r' || p[0] == '\n':
+			out = append(out, keyEnter)
+			p = p[1:]
+		case p[0] == 0x7f || p[0] == 0x08:
+			out = append(out, keyBackspace)
+			p = p[1:]
+		case p[0] == 0x03:
+			out = append(out, keyInterrupt)
+			p = p[1:]
+		case p[0] == 0x1a:
+			out = append(out, keyUndo)
+			p = p[1:]
+		case p[0] == 0x19:
+			out = append(out, keyRedo)
+			p = p[1:]
+		case p[0] < 0x20:
+			p = p[1:]
+		default:
+			r, size := utf8.DecodeRune(p)
+			out = append(out, string(r))
+			p = p[size:]
+		}
+	}
+	return out
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/cmd/four/pkg"
+	"github.com/astromechza/automerge-experiments/pkg/handle"
+	"github.com/astromechza/automerge-experiments/pkg/syncprogress"
+	"github.com/astromechza/automerge-experiments/pkg/todo"
+	"github.com/astromechza/automerge-experiments/pkg/undo"
+)
+
+type ui struct {
+	c *client
+
+	tasks      []todo.Task
+	selectedID string
+	selected   int
+	peers      []pkg.Presence
+
+	// prompt is set while reading a line of input, which is passed to onSubmit. Live prompts also pass each change of
+	// the input to onChange, and call onCancel if the input is abandoned.
+	prompt   string
+	input    []rune
+	onSubmit func(string) error
+	onChange func(string) error
+	onCancel func()
+	message  string
+}
+
+func runUI(ctx context.Context, c *client) error {
+	restore, err := makeRaw()
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	keys := make(chan []string)
+	readErr := make(chan error, 1)
+	go func() {
+		buff := make([]byte, 64)
+		for {
+			n, err := os.Stdin.Read(buff)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			keys <- parseKeys(buff[:n])
+		}
+	}()
+
+	u := &ui{c: c}
+	if err := u.refresh(); err != nil {
+		return err
+	}
+	u.render()
+
+	// edits arrive from the sync goroutine as well as our own, so only note them here and redraw from the loop
+	changed := make(chan struct{}, 1)
+	unsubscribe := c.docHandle.Subscribe(func([]handle.Patch) {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}, "tasks")
+	defer unsubscribe()
+
+	t := time.NewTicker(time.Millisecond * 250)
+	defer t.Stop()
+	lastStatus := ""
+	for {
+		select {
+		case ks := <-keys:
+			for _, k := range ks {
+				if quit := u.handleKey(k); quit {
+					return nil
+				}
+			}
+			if err := u.refresh(); err != nil {
+				return err
+			}
+			u.render()
+		case <-changed:
+			if err := u.refresh(); err != nil {
+				return err
+			}
+			u.render()
+		case <-t.C:
+			// presence and the connection status are not part of the doc, so poll for them to redraw
+			status, _ := c.Status()
+			status += progressLabel(c.Progress())
+			if status != lastStatus || !slices.Equal(c.Peers(), u.peers) {
+				lastStatus = status
+				if err := u.refresh(); err != nil {
+					return err
+				}
+				u.render()
+			}
+		case err := <-readErr:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// refresh reloads the tasks and peers, and tells the peers which task is selected.
+func (u *ui) refresh() error {
+	defer func() {
+		u.c.SetPresence(u.selectedID, u.onSubmit != nil)
+	}()
+	u.peers = u.c.Peers()
+	return u.c.view(func(doc *automerge.Doc) error {
+		tasks, err := todo.Query(doc, todo.Filter{})
+		if err != nil {
+			return err
+		}
+		u.tasks = tasks
+		// keep the same task selected as others add and move tasks around it
+		if i := slices.IndexFunc(tasks, func(t todo.Task) bool { return t.ID == u.selectedID }); i >= 0 {
+			u.selected = i
+		}
+		u.selected = max(0, min(u.selected, len(tasks)-1))
+		if len(tasks) > 0 {
+			u.selectedID = tasks[u.selected].ID
+		}
+		return nil
+	})
+}
+
+// peerLabel names a peer by its display name, falling back to who it authenticated as.
+func peerLabel(p pkg.Presence) string {
+	switch {
+	case p.Name != "":
+		return p.Name
+	case p.Subject != "":
+		return p.Subject
+	}
+	return p.Session
+}
+
+func (u *ui) selectedTask() (todo.Task, bool) {
+	if u.selected < len(u.tasks) {
+		return u.tasks[u.selected], true
+	}
+	return todo.Task{}, false
+}
+
+func (u *ui) ask(prompt, initial string, onSubmit func(string) error) {
+	u.prompt, u.input, u.onSubmit = prompt, []rune(initial), onSubmit
+	u.onChange, u.onCancel = nil, nil
+}
+
+// askLive is ask for edits that are applied as they are typed, such as inside a batch scope that onSubmit ends.
+func (u *ui) askLive(prompt, initial string, onChange, onSubmit func(string) error, onCancel func()) {
+	u.ask(prompt, initial, onSubmit)
+	u.onChange, u.onCancel = onChange, onCancel
+}
+
+func (u *ui) inputChanged() {
+	if u.onChange == nil {
+		return
+	}
+	if err := u.onChange(string(u.input)); err != nil {
+		u.message = err.Error()
+	}
+}
+
+func (u *ui) do(op func(doc *automerge.Doc) (string, error)) {
+	if err := u.c.edit(op); err != nil {
+		u.message = err.Error()
+	}
+}
+
+// revert runs todo.Undo or todo.Redo against the history of the client.
+func (u *ui) revert(op func(doc *automerge.Doc, m *undo.Manager) (bool, error), verb string) {
+	var done bool
+	if err := u.c.write(func(doc *automerge.Doc) error {
+		var err error
+		done, err = op(doc, u.c.history)
+		return err
+	}); err != nil {
+		u.message = err.Error()
+	} else if !done {
+		u.message = "nothing to " + verb
+	}
+}
+
+// handleKey applies a key press and returns true if the ui should exit.
+func (u *ui) handleKey(k string) bool {
+	if k == keyInterrupt {
+		return true
+	}
+	if u.onSubmit != nil {
+		switch k {
+		case keyEscape:
+			if u.onCancel != nil {
+				u.onCancel()
+			}
+			u.onSubmit = nil
+		case keyEnter:
+			submit := u.onSubmit
+			u.onSubmit = nil
+			if err := submit(string(u.input)); err != nil {
+				u.message = err.Error()
+			}
+		case keyBackspace:
+			if len(u.input) > 0 {
+				u.input = u.input[:len(u.input)-1]
+				u.inputChanged()
+			}
+		case keyUp, keyDown, keyUndo, keyRedo:
+		default:
+			u.input = append(u.input, []rune(k)...)
+			u.inputChanged()
+		}
+		return false
+	}
+
+	u.message = ""
+	task, ok := u.selectedTask()
+	switch k {
+	case "q":
+		return true
+	case "j", keyDown:
+		u.selected = min(u.selected+1, len(u.tasks)-1)
+		u.selectedID = ""
+	case "k", keyUp:
+		u.selected = max(u.selected-1, 0)
+		u.selectedID = ""
+	case "a":
+		u.ask("add: ", "", func(title string) error {
+			if strings.TrimSpace(title) == "" {
+				return nil
+			}
+			return u.c.edit(func(doc *automerge.Doc) (string, error) {
+				id, msg, err := todo.Add(doc, todo.NewTask{Title: title})
+				u.selectedID = id
+				return msg, err
+			})
+		})
+	case "e":
+		if !ok {
+			break
+		}
+		// the title changes as it is typed, and the keystrokes are committed as a single rename when it is submitted
+		if err := u.c.batch.Begin(); err != nil {
+			u.message = err.Error()
+			break
+		}
+		// a cleared field leaves the last title pending, since a task can't have an empty one
+		u.askLive("edit: ", task.Title, func(title string) error {
+			if title == "" {
+				return nil
+			}
+			return u.c.edit(func(doc *automerge.Doc) (string, error) {
+				return todo.Rename(doc, task.ID, title)
+			})
+		}, func(title string) error {
+			if title == "" {
+				u.c.batch.Discard()
+				return todo.ErrTitleRequired
+			}
+			return u.c.batch.End(fmt.Sprintf("rename task %s to %q", task.ID, title))
+		}, u.c.batch.Discard)
+	case "D":
+		if ok {
+			u.ask("description: ", task.Description, func(description string) error {
+				return u.c.edit(func(doc *automerge.Doc) (string, error) {
+					return todo.SetDescription(doc, task.ID, description)
+				})
+			})
+		}
+	case " ", "x":
+		if ok {
+			u.do(func(doc *automerge.Doc) (string, error) {
+				if task.Status == todo.StatusDone {
+					return todo.Reopen(doc, task.ID)
+				}
+				return todo.Complete(doc, task.ID)
+			})
+		}
+	case "J", "K":
+		if ok {
+			to := u.selected + 1
+			if k == "K" {
+				to = u.selected - 1
+			}
+			if to >= 0 && to < len(u.tasks) {
+				u.do(func(doc *automerge.Doc) (string, error) {
+					return todo.Move(doc, task.ID, to)
+				})
+			}
+		}
+	case "u", keyUndo:
+		u.revert(todo.Undo, "undo")
+	case "U", keyRedo:
+		u.revert(todo.Redo, "redo")
+	case "d":
+		if ok {
+			u.ask(fmt.Sprintf("delete %q? (y/n) ", task.Title), "", func(answer string) error {
+				if answer != "y" {
+					return nil
+				}
+				return u.c.edit(func(doc *automerge.Doc) (string, error) {
+					return todo.Delete(doc, task.ID)
+				})
+			})
+		}
+	}
+	return false
+}
+
+// progressLabel shows a bar while changes are still arriving, and a tick once the server and we have the same heads.
+func progressLabel(p syncprogress.Progress) string {
+	const width = 20
+	switch {
+	case p.InSync:
+		return " ✓ synced"
+	case p.Outstanding > 0:
+		done := int(p.Fraction() * width)
+		return fmt.Sprintf(" syncing [%s%s] %d/%d changes", strings.Repeat("#", done), strings.Repeat(".", width-done), p.ChangesApplied, p.ChangesApplied+p.Outstanding)
+	case p.MessagesSent > 0 || p.MessagesReceived > 0:
+		return " syncing"
+	}
+	return ""
+}
+
+func truncate(s string, width int) string {
+	r := []rune(s)
+	if width <= 0 {
+		return ""
+	} else if len(r) > width {
+		return string(r[:width-1]) + "…"
+	}
+	return s
+}
+
+func (u *ui) render() {
+	rows, cols := termSize()
+	var b strings.Builder
+	line := func(s string) {
+		b.WriteString(truncate(s, cols))
+		b.WriteString("\x1b[K\r\n")
+	}
+	b.WriteString("\x1b[H")
+
+	status, role := u.c.Status()
+	line(fmt.Sprintf("\x1b[1mTODO\x1b[0m  %s @ %s", u.c.store, u.c.baseUrl.Host))
+	line("")
+
+	// keep the selection in view, leaving room for the header and the footer
+	listRows := max(1, rows-7)
+	start := max(0, u.selected-listRows+1)
+	for i := start; i < len(u.tasks) && i < start+listRows; i++ {
+		text := " " + formatTask(u.tasks[i])
+		for _, p := range u.peers {
+			if p.Focus == u.tasks[i].ID {
+				text += "  ◂ " + peerLabel(p)
+				if p.Typing {
+					text += " is typing"
+				}
+			}
+		}
+		if i == u.selected {
+			b.WriteString("\x1b[7m")
+			line(text + "\x1b[0m")
+			// only the first line of the description fits under the task
+			if d, _, _ := strings.Cut(u.tasks[i].Description, "\n"); d != "" {
+				line("\x1b[2m     " + d + "\x1b[0m")
+			}
+		} else {
+			line(text)
+		}
+	}
+	if len(u.tasks) == 0 {
+		line(" nothing to do, press a to add a task")
+	}
+	b.WriteString("\x1b[J")
+
+	b.WriteString(fmt.Sprintf("\x1b[%d;1H", rows-3))
+	line("\x1b[2m a add  e edit  D describe  space done  J/K move  d delete  u/^Z undo  U/^Y redo  q quit\x1b[0m")
+	connected := status == "connected"
+	if role != "" {
+		status += " as " + string(role)
+	}
+	if connected {
+		status += progressLabel(u.c.Progress())
+	}
+	peers := "nobody else"
+	if len(u.peers) > 0 {
+		labels := make([]string, len(u.peers))
+		for i, p := range u.peers {
+			labels[i] = peerLabel(p)
+		}
+		peers = strings.Join(labels, ", ")
+	}
+	line(fmt.Sprintf(" %s · online: %s · %d tasks", status, peers, len(u.tasks)))
+	if u.onSubmit != nil {
+		line(" " + u.prompt + string(u.input) + "█")
+	} else {
+		line(" " + u.message)
+	}
+	fmt.Print(b.String())
+}
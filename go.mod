@@ -2,16 +2,18 @@ module github.com/astromechza/automerge-experiments
 
 go 1.21.0
 
-require github.com/automerge/automerge-go v0.0.0-20230903201930-b80ce8aadbb9
+require (
+	github.com/automerge/automerge-go v0.0.0-20230903201930-b80ce8aadbb9
+	github.com/felixge/httpsnoop v1.0.4
+	github.com/goccy/go-graphviz v0.1.2
+	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.1
+	github.com/mattn/go-sqlite3 v1.14.19
+)
 
 require (
-	github.com/felixge/httpsnoop v1.0.4 // indirect
 	github.com/fogleman/gg v1.3.0 // indirect
-	github.com/goccy/go-graphviz v0.1.2 // indirect
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/gorilla/websocket v1.5.1 // indirect
-	github.com/mattn/go-sqlite3 v1.14.19 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	golang.org/x/image v0.14.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrInvalidToken is returned when a token is malformed, unknown, expired, or revoked. We deliberately don't tell the
+// caller which.
+var ErrInvalidToken = errors.New("invalid token")
+
+// Token is the stored record of an issued token. The secret itself is never stored, only its hash.
+type Token struct {
+	Id        string
+	Subject   string
+	ExpiresAt *time.Time
+	RevokedAt *time.Time
+}
+
+// TokenStore issues and verifies bearer tokens of the form "<id>.<secret>" backed by a table in the given database.
+type TokenStore struct {
+	database *sql.DB
+}
+
+func NewTokenStore(database *sql.DB) *TokenStore {
+	return &TokenStore{database: database}
+}
+
+func (s *TokenStore) Init() error {
+	if _, err := s.database.Exec(
+		`CREATE TABLE IF NOT EXISTS tokens (
+    	id text not null primary key,
+    	subject text not null,
+    	secret_hash text not null,
+    	expires_at integer,
+    	revoked_at integer
+		)`,
+	); err != nil {
+		return fmt.Errorf("failed to create tokens table: %w", err)
+	}
+	return nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue creates a new token for the subject. A ttl of 0 means the token does not expire. The returned string is the
+// only copy of the secret.
+func (s *TokenStore) Issue(ctx context.Context, subject string, ttl time.Duration) (string, error) {
+	rawId := make([]byte, 8)
+	rawSecret := make([]byte, 32)
+	if _, err := rand.Read(rawId); err != nil {
+		return "", fmt.Errorf("failed to generate token id: %w", err)
+	}
+	if _, err := rand.Read(rawSecret); err != nil {
+		return "", fmt.Errorf("failed to generate token secret: %w", err)
+	}
+	id, secret := hex.EncodeToString(rawId), base64.RawURLEncoding.EncodeToString(rawSecret)
+
+	var expiresAt *int64
+	if ttl > 0 {
+		e := time.Now().Add(ttl).Unix()
+		expiresAt = &e
+	}
+	if _, err := s.database.ExecContext(
+		ctx, `INSERT INTO tokens(id, subject, secret_hash, expires_at) VALUES (?, ?, ?, ?)`,
+		id, subject, hashSecret(secret), expiresAt,
+	); err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return id + "." + secret, nil
+}
+
+// Revoke marks the token as revoked, it will fail verification from now on.
+func (s *TokenStore) Revoke(ctx context.Context, id string) error {
+	res, err := s.database.ExecContext(ctx, `UPDATE tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, time.Now().Unix(), id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	} else if r, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to count rows affected by revoke: %w", err)
+	} else if r == 0 {
+		return fmt.Errorf("no active token with id %q", id)
+	}
+	return nil
+}
+
+// Verify checks the token against the store and returns its record if it is valid now.
+func (s *TokenStore) Verify(ctx context.Context, token string) (*Token, error) {
+	id, secret, ok := strings.Cut(token, ".")
+	if !ok || id == "" || secret == "" {
+		return nil, ErrInvalidToken
+	}
+
+	var out Token
+	var secretHash string
+	var expiresAt, revokedAt sql.NullInt64
+	if err := s.database.QueryRowContext(
+		ctx, `SELECT id, subject, secret_hash, expires_at, revoked_at FROM tokens WHERE id = ?`, id,
+	).Scan(&out.Id, &out.Subject, &secretHash, &expiresAt, &revokedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidToken
+		}
+		return nil, fmt.Errorf("failed to query token: %w", err)
+	}
+	if subtle.ConstantTimeCompare([]byte(secretHash), []byte(hashSecret(secret))) != 1 {
+		return nil, ErrInvalidToken
+	}
+	if expiresAt.Valid {
+		e := time.Unix(expiresAt.Int64, 0)
+		out.ExpiresAt = &e
+		if time.Now().After(e) {
+			return nil, ErrInvalidToken
+		}
+	}
+	if revokedAt.Valid {
+		return nil, ErrInvalidToken
+	}
+	return &out, nil
+}
+
+type tokenContextKey struct{}
+
+// FromContext returns the verified token of the request, if the Middleware let it through.
+func FromContext(ctx context.Context) (*Token, bool) {
+	t, ok := ctx.Value(tokenContextKey{}).(*Token)
+	return t, ok
+}
+
+// Middleware rejects any request that does not carry a valid "Authorization: Bearer <token>" header. It can be used
+// with both gorilla/mux routers and plain http handlers.
+func (s *TokenStore) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		raw, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="stores"`)
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token, err := s.Verify(request.Context(), strings.TrimSpace(raw))
+		if err != nil {
+			if !errors.Is(err, ErrInvalidToken) {
+				slog.Error("failed to verify token", "err", err)
+				writer.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="stores", error="invalid_token"`)
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), tokenContextKey{}, token)))
+	})
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// TokenEnvVar is the environment variable that clients read the token from when no flag is given.
+const TokenEnvVar = "AUTOMERGE_TOKEN"
+
+// ResolveToken picks the client's token from the explicit value, then the file, then the environment.
+func ResolveToken(token, tokenFile string) (string, error) {
+	if token != "" {
+		return token, nil
+	}
+	if tokenFile != "" {
+		raw, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read token file: %w", err)
+		}
+		return strings.TrimSpace(string(raw)), nil
+	}
+	if v := os.Getenv(TokenEnvVar); v != "" {
+		return strings.TrimSpace(v), nil
+	}
+	return "", fmt.Errorf("no token given, use -token, -token-file, or $%s", TokenEnvVar)
+}
+
+// Header returns the headers that carry the token, for use when dialing a websocket.
+func Header(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+// Transport adds the token to every request sent through it.
+type Transport struct {
+	Token string
+	Base  http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(request *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	request = request.Clone(request.Context())
+	request.Header.Set("Authorization", "Bearer "+t.Token)
+	return base.RoundTrip(request)
+}
+
+// NewClient returns a http client that authenticates every request with the token.
+func NewClient(token string) *http.Client {
+	return &http.Client{Transport: &Transport{Token: token}}
+}
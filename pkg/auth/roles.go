@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoAccess is returned when the subject has no role on the store.
+var ErrNoAccess = errors.New("no access to store")
+
+// RoleHeader is set on sync responses so that the client knows whether its changes will be accepted.
+const RoleHeader = "X-Store-Role"
+
+type Role string
+
+const (
+	RoleReader Role = "reader"
+	RoleWriter Role = "writer"
+	RoleOwner  Role = "owner"
+)
+
+// CanWrite returns true if changes from this role may be merged into the store.
+func (r Role) CanWrite() bool {
+	return r == RoleWriter || r == RoleOwner
+}
+
+func ParseRole(raw string) (Role, error) {
+	switch r := Role(raw); r {
+	case RoleReader, RoleWriter, RoleOwner:
+		return r, nil
+	default:
+		return "", fmt.Errorf("unknown role %q, expected one of reader, writer, owner", raw)
+	}
+}
+
+// RoleStore holds the role of each subject on each store.
+type RoleStore struct {
+	database *sql.DB
+}
+
+func NewRoleStore(database *sql.DB) *RoleStore {
+	return &RoleStore{database: database}
+}
+
+func (s *RoleStore) Init() error {
+	if _, err := s.database.Exec(
+		`CREATE TABLE IF NOT EXISTS store_roles (
+    	store_id text not null,
+    	subject text not null,
+    	role text not null,
+    	primary key (store_id, subject)
+		)`,
+	); err != nil {
+		return fmt.Errorf("failed to create store roles table: %w", err)
+	}
+	return nil
+}
+
+// Grant sets the subject's role on the store, replacing any existing role.
+func (s *RoleStore) Grant(ctx context.Context, store, subject string, role Role) error {
+	if _, err := s.database.ExecContext(
+		ctx, `INSERT OR REPLACE INTO store_roles(store_id, subject, role) VALUES (?, ?, ?)`, store, subject, string(role),
+	); err != nil {
+		return fmt.Errorf("failed to grant role: %w", err)
+	}
+	return nil
+}
+
+// GrantSpec applies a grant in the "<store>:<subject>:<role>" form used by the server flags.
+func (s *RoleStore) GrantSpec(ctx context.Context, spec string) error {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid grant %q, expected <store>:<subject>:<role>", spec)
+	}
+	role, err := ParseRole(parts[2])
+	if err != nil {
+		return err
+	}
+	return s.Grant(ctx, parts[0], parts[1], role)
+}
+
+// RoleOf returns the subject's role on the store or ErrNoAccess.
+func (s *RoleStore) RoleOf(ctx context.Context, store, subject string) (Role, error) {
+	var raw string
+	if err := s.database.QueryRowContext(
+		ctx, `SELECT role FROM store_roles WHERE store_id = ? AND subject = ?`, store, subject,
+	).Scan(&raw); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNoAccess
+		}
+		return "", fmt.Errorf("failed to query role: %w", err)
+	}
+	return ParseRole(raw)
+}
+
+// RoleOfRequest looks up the role of the authenticated subject of the request.
+func (s *RoleStore) RoleOfRequest(ctx context.Context, store string) (Role, error) {
+	token, ok := FromContext(ctx)
+	if !ok {
+		return "", ErrNoAccess
+	}
+	return s.RoleOf(ctx, store, token.Subject)
+}
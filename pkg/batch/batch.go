@@ -0,0 +1,233 @@
+// Package batch gathers rapid local edits to a document into a single commit.
+//
+// Automerge commits any pending operations before it generates or receives a sync message, so edits can't simply be
+// left uncommitted in the shared doc while the sync runs. Instead a Batcher makes its edits on a fork of the doc with
+// the same actor, and merges the fork back in one commit when the batch is flushed: after a window since the first
+// edit, or at the end of an explicit Begin and End scope. Until then, View shows the edits on the fork.
+//
+// The edits leave their operations pending and return a message describing them, the way the operations of package
+// todo do, and the batch is committed with their messages.
+//
+// Every local edit must go through the Batcher, or Flush it first, since two commits by the same actor on the doc and
+// on the fork would clash when merged. Edits must not read the heads of the fork, such as to make a richtext cursor,
+// since that commits the batch so far as a change of its own.
+package batch
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// DefaultWindow is how long after the first edit of a batch it is committed.
+const DefaultWindow = time.Millisecond * 500
+
+type Batcher struct {
+	// docLock guards the doc, it is the same lock that the sync holds
+	docLock sync.Locker
+	doc     *automerge.Doc
+	flushed chan struct{}
+
+	// Window is how long after the first edit a batch outside of a scope is committed, zero commits after every Edit.
+	Window time.Duration
+	// Commit commits the batch on the fork, by default with the joined messages. The messages are never empty.
+	Commit func(fork *automerge.Doc, messages []string) error
+	// OnFlush is called with the doc and its heads from before the batch was merged, while the doc lock is held. Like
+	// anything the doc lock calls on unlock, it must not call back into the Batcher.
+	OnFlush func(doc *automerge.Doc, before []automerge.ChangeHash)
+
+	lock     sync.Mutex
+	fork     *automerge.Doc
+	messages []string
+	depth    int
+	timer    *time.Timer
+}
+
+func New(doc *automerge.Doc, docLock sync.Locker) *Batcher {
+	return &Batcher{docLock: docLock, doc: doc, flushed: make(chan struct{}, 1), Window: DefaultWindow, Commit: commitJoined}
+}
+
+func commitJoined(fork *automerge.Doc, messages []string) error {
+	_, err := fork.Commit(Message(messages))
+	return err
+}
+
+// Message summarises the messages of a batch for its commit: a single message as it is, or a count followed by the
+// distinct messages one per line.
+func Message(messages []string) string {
+	distinct := make([]string, 0, len(messages))
+	for _, m := range messages {
+		if len(distinct) == 0 || distinct[len(distinct)-1] != m {
+			distinct = append(distinct, m)
+		}
+	}
+	if len(distinct) == 1 {
+		return distinct[0]
+	}
+	return fmt.Sprintf("%d edits\n\n%s", len(messages), strings.Join(distinct, "\n"))
+}
+
+// Flushed receives a value after each batch is merged into the doc, so that the sync can send it straight away.
+func (b *Batcher) Flushed() <-chan struct{} {
+	return b.flushed
+}
+
+// Edit runs the function against the pending batch, starting one if needed. Outside a scope the batch is committed once
+// the window has passed since its first edit. The function returns the message describing its edit, or an empty one if
+// it changed nothing, and a batch with no messages is dropped rather than committed.
+//
+// If the function fails the whole batch is discarded, including the earlier edits in it, since the fork can't tell
+// their pending operations from those the function left behind.
+func (b *Batcher) Edit(fn func(doc *automerge.Doc) (string, error)) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.fork == nil {
+		b.docLock.Lock()
+		fork, err := b.doc.Fork()
+		if err == nil {
+			err = fork.SetActorID(b.doc.ActorID())
+		}
+		b.docLock.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed to start batch: %w", err)
+		}
+		b.fork = fork
+	}
+	msg, err := fn(b.fork)
+	if err != nil {
+		b.reset()
+		return err
+	}
+	if msg != "" {
+		b.messages = append(b.messages, msg)
+	}
+	if b.depth == 0 && b.Window <= 0 {
+		return b.flush()
+	} else if b.depth == 0 && b.timer == nil {
+		b.timer = time.AfterFunc(b.Window, b.flushWindow)
+	}
+	return nil
+}
+
+// flushWindow commits the batch once its window has passed. There is no caller to return an error to, so it is logged,
+// and the edits stay pending until the next edit starts a new window or the batch is flushed.
+func (b *Batcher) flushWindow() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.timer = nil
+	// a scope may have begun while the timer was firing, the end of the scope commits the batch instead
+	if b.depth > 0 {
+		return
+	}
+	if err := b.flush(); err != nil {
+		slog.Error("failed to flush batch", "err", err)
+	}
+}
+
+// View runs the function against the pending batch if there is one, so that the edits show before they are committed,
+// and otherwise against the doc.
+func (b *Batcher) View(fn func(doc *automerge.Doc) error) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.fork != nil {
+		return fn(b.fork)
+	}
+	b.docLock.Lock()
+	defer b.docLock.Unlock()
+	return fn(b.doc)
+}
+
+// Begin opens a scope: edits until the matching End are committed together, whatever the window. Scopes nest. Edits
+// pending from before the outermost scope are committed first, so that discarding the scope leaves them be.
+func (b *Batcher) Begin() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.depth == 0 {
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	b.depth++
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return nil
+}
+
+// End closes a scope, and commits the batch when the outermost scope ends. The message, if given, replaces the
+// messages of the edits in the scope.
+func (b *Batcher) End(msg string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.depth == 0 {
+		return fmt.Errorf("end of a batch scope that was not begun")
+	}
+	b.depth--
+	if b.depth > 0 {
+		return nil
+	}
+	if msg != "" && len(b.messages) > 0 {
+		b.messages = []string{msg}
+	}
+	return b.flush()
+}
+
+// Discard drops the pending batch and closes every scope, as if the edits never happened.
+func (b *Batcher) Discard() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.reset()
+	b.depth = 0
+}
+
+// Flush commits the pending batch now, even inside a scope. Later edits in the scope start a new batch.
+func (b *Batcher) Flush() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.flush()
+}
+
+func (b *Batcher) reset() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.fork, b.messages = nil, nil
+}
+
+func (b *Batcher) flush() error {
+	if b.fork == nil {
+		return nil
+	}
+	fork, messages := b.fork, b.messages
+	if len(messages) == 0 {
+		// none of the edits changed anything
+		b.reset()
+		return nil
+	}
+	if err := b.Commit(fork, messages); err != nil {
+		return fmt.Errorf("failed to commit batch: %w", err)
+	}
+	b.reset()
+
+	b.docLock.Lock()
+	before := b.doc.Heads()
+	_, err := b.doc.Merge(fork)
+	if err == nil && b.OnFlush != nil {
+		b.OnFlush(b.doc, before)
+	}
+	b.docLock.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to merge batch: %w", err)
+	}
+	select {
+	case b.flushed <- struct{}{}:
+	default:
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Package changehash converts the heads of a document to and from the strings used on the wire and in documents, and
+// derives actors from them.
+package changehash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+
+	"github.com/automerge/automerge-go"
+)
+
+// Encode returns the hashes as sorted strings, so that the same heads always encode the same way.
+func Encode(heads []automerge.ChangeHash) []string {
+	out := make([]string, len(heads))
+	for i, h := range heads {
+		out[i] = h.String()
+	}
+	slices.Sort(out)
+	return out
+}
+
+// Decode parses hashes encoded by Encode.
+func Decode(raw []string) ([]automerge.ChangeHash, error) {
+	out := make([]automerge.ChangeHash, len(raw))
+	for i, r := range raw {
+		h, err := automerge.NewChangeHash(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid head %q: %w", r, err)
+		}
+		out[i] = h
+	}
+	return out, nil
+}
+
+// Actor derives an actor id from a label and the heads a change starts from. Peers that make the same change from the
+// same heads with a derived actor and a fixed time produce byte-identical changes, which automerge deduplicates when
+// they sync. The label keeps the actors of different kinds of change apart.
+func Actor(label string, heads []automerge.ChangeHash) string {
+	sum := sha256.New()
+	_, _ = fmt.Fprint(sum, label)
+	for _, h := range Encode(heads) {
+		_, _ = fmt.Fprintf(sum, ":%s", h)
+	}
+	return hex.EncodeToString(sum.Sum(nil)[:16])
+}
+
+// IsDerived returns true if the change was made by an actor derived with one of the labels from the heads it started
+// from, which are its dependencies.
+func IsDerived(change *automerge.Change, labels []string) bool {
+	for _, label := range labels {
+		if change.ActorID() == Actor(label, change.Dependencies()) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,280 @@
+// Package codec maps Go values to automerge maps and lists using struct tags.
+//
+// Fields are named with the same `automerge:"name"` tag that automerge.As understands, with extra options after the
+// name:
+//
+//	Title string `automerge:"title,text"`      // stored as Text, and updated with a minimal splice
+//	Votes int64  `automerge:"votes,counter"`   // stored as a Counter, and updated with an increment
+//	Notes string `automerge:"notes,omitempty"` // deleted from the map when empty
+//	Cache string `automerge:"-"`               // never stored
+//
+// Encode compares the value with what is already in the doc and only writes what differs. Re-encoding an unchanged
+// value creates no operations, and a changed value only touches the changed fields, so concurrent edits to other
+// fields are not overwritten with stale copies.
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+type fieldOptions struct {
+	text      bool
+	counter   bool
+	omitEmpty bool
+}
+
+func parseField(ft reflect.StructField) (string, fieldOptions, bool) {
+	tag := ft.Tag.Get("automerge")
+	if tag == "-" || !ft.IsExported() {
+		return "", fieldOptions{}, false
+	}
+	name, rest, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = ft.Name
+	}
+	var opts fieldOptions
+	for _, o := range strings.Split(rest, ",") {
+		switch o {
+		case "text":
+			opts.text = true
+		case "counter":
+			opts.counter = true
+		case "omitempty":
+			opts.omitEmpty = true
+		}
+	}
+	return name, opts, true
+}
+
+// Decode reads the value at the path into T. A missing value decodes to the zero T.
+func Decode[T any](p *automerge.Path) (T, error) {
+	v, err := p.Get()
+	if err != nil {
+		var zero T
+		return zero, fmt.Errorf("failed to get %s: %w", p, err)
+	} else if v.IsVoid() {
+		var zero T
+		return zero, nil
+	}
+	return automerge.As[T](v)
+}
+
+// Encode writes the value to the path, only changing the parts of the doc that differ from it. Structs and string keyed
+// maps are stored as maps, and slices other than []byte as lists, which are compared element by element.
+func Encode(p *automerge.Path, v any) error {
+	return encode(p, reflect.ValueOf(v), fieldOptions{})
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func encode(p *automerge.Path, rv reflect.Value, opts fieldOptions) error {
+	for rv.IsValid() && (rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface) {
+		if rv.IsNil() {
+			return remove(p)
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return remove(p)
+	}
+	current, err := p.Get()
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", p, err)
+	}
+
+	switch {
+	case rv.Type() == timeType:
+		t := rv.Interface().(time.Time)
+		if current.Kind() == automerge.KindTime && current.Time().UnixMilli() == t.UnixMilli() {
+			return nil
+		}
+		return set(p, t)
+
+	case opts.text && rv.Kind() == reflect.String:
+		if current.Kind() != automerge.KindText {
+			return set(p, automerge.NewText(rv.String()))
+		}
+		if _, err := UpdateText(current.Text(), rv.String()); err != nil {
+			return fmt.Errorf("failed to update %s: %w", p, err)
+		}
+		return nil
+
+	case opts.counter && rv.CanInt():
+		if current.Kind() != automerge.KindCounter {
+			return set(p, automerge.NewCounter(rv.Int()))
+		}
+		before, err := current.Counter().Get()
+		if err != nil {
+			return fmt.Errorf("failed to get %s: %w", p, err)
+		}
+		if delta := rv.Int() - before; delta != 0 {
+			if err := current.Counter().Inc(delta); err != nil {
+				return fmt.Errorf("failed to increment %s: %w", p, err)
+			}
+		}
+		return nil
+
+	case rv.Kind() == reflect.Struct:
+		if current.Kind() != automerge.KindMap {
+			if err := set(p, automerge.NewMap()); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < rv.NumField(); i++ {
+			name, fieldOpts, ok := parseField(rv.Type().Field(i))
+			if !ok {
+				continue
+			}
+			field := rv.Field(i)
+			if fieldOpts.omitEmpty && field.IsZero() {
+				err = remove(p.Path(name))
+			} else {
+				err = encode(p.Path(name), field, fieldOpts)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case rv.Kind() == reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return fmt.Errorf("%s: unsupported map, must have string keys", p)
+		}
+		if current.Kind() != automerge.KindMap {
+			if err := set(p, automerge.NewMap()); err != nil {
+				return err
+			}
+		} else {
+			keys, err := current.Map().Keys()
+			if err != nil {
+				return fmt.Errorf("failed to list keys of %s: %w", p, err)
+			}
+			for _, key := range keys {
+				if !rv.MapIndex(reflect.ValueOf(key).Convert(rv.Type().Key())).IsValid() {
+					if err := remove(p.Path(key)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		iter := rv.MapRange()
+		for iter.Next() {
+			if err := encode(p.Path(iter.Key().String()), iter.Value(), fieldOptions{}); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case (rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array) && rv.Type().Elem().Kind() == reflect.Uint8:
+		raw := make([]byte, rv.Len())
+		reflect.Copy(reflect.ValueOf(raw), rv)
+		if current.Kind() == automerge.KindBytes && bytes.Equal(current.Bytes(), raw) {
+			return nil
+		}
+		return set(p, raw)
+
+	case rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array:
+		if current.Kind() != automerge.KindList {
+			if err := set(p, automerge.NewList()); err != nil {
+				return err
+			}
+		}
+		list := p.List()
+		for list.Len() > rv.Len() {
+			if err := list.Delete(list.Len() - 1); err != nil {
+				return fmt.Errorf("failed to truncate %s: %w", p, err)
+			}
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if i == list.Len() {
+				// appended as null first so that the element is encoded with the same rules as existing ones
+				if err := list.Append(nil); err != nil {
+					return fmt.Errorf("failed to append to %s: %w", p, err)
+				}
+			}
+			if err := encode(p.Path(i), rv.Index(i), fieldOptions{}); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		if sameScalar(current, rv) {
+			return nil
+		}
+		return set(p, rv.Interface())
+	}
+}
+
+func set(p *automerge.Path, v any) error {
+	if err := p.Set(v); err != nil {
+		return fmt.Errorf("failed to set %s: %w", p, err)
+	}
+	return nil
+}
+
+func remove(p *automerge.Path) error {
+	current, err := p.Get()
+	if err != nil {
+		return fmt.Errorf("failed to get %s: %w", p, err)
+	} else if current.IsVoid() {
+		return nil
+	}
+	if err := p.Delete(); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", p, err)
+	}
+	return nil
+}
+
+// sameScalar compares the stored value with a Go scalar. Numbers compare by value since automerge stores most Go
+// integer types as floats.
+func sameScalar(current *automerge.Value, rv reflect.Value) bool {
+	switch rv.Kind() {
+	case reflect.Bool:
+		return current.Kind() == automerge.KindBool && current.Bool() == rv.Bool()
+	case reflect.String:
+		return current.Kind() == automerge.KindStr && current.Str() == rv.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return current.Kind() == automerge.KindInt64 && current.Int64() == rv.Int() ||
+			current.Kind() == automerge.KindFloat64 && current.Float64() == float64(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return current.Kind() == automerge.KindUint64 && current.Uint64() == rv.Uint() ||
+			current.Kind() == automerge.KindFloat64 && current.Float64() == float64(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		return current.Kind() == automerge.KindFloat64 && current.Float64() == rv.Float()
+	}
+	return false
+}
+
+// UpdateText changes the text to s with the smallest splice, so that concurrent edits to the rest of the text are kept.
+// It returns false if the text was already s.
+func UpdateText(text *automerge.Text, s string) (bool, error) {
+	before, err := text.Get()
+	if err != nil {
+		return false, err
+	}
+	pos, del, insert := minimalSplice([]rune(before), []rune(s))
+	if del == 0 && insert == "" {
+		return false, nil
+	}
+	return true, text.Splice(pos, del, insert)
+}
+
+func minimalSplice(before, after []rune) (int, int, string) {
+	prefix := 0
+	for prefix < len(before) && prefix < len(after) && before[prefix] == after[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(before)-prefix && suffix < len(after)-prefix && before[len(before)-1-suffix] == after[len(after)-1-suffix] {
+		suffix++
+	}
+	return prefix, len(before) - prefix - suffix, string(after[prefix : len(after)-suffix])
+}
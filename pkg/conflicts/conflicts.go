@@ -0,0 +1,221 @@
+// Package conflicts finds the keys of a document that hold concurrent conflicting values.
+//
+// When two peers set the same map key without seeing each other's write, automerge keeps both values and picks a
+// winner deterministically. The version of automerge-go used here only exposes the winner, so the conflicts are
+// rebuilt from the history instead: every change is diffed against its dependencies to find the paths it wrote, and a
+// write is still competing if no later write to the same path has seen it. Paths with more than one competing write
+// are conflicts.
+//
+// Text and counters merge concurrent edits rather than picking a winner, so they never conflict. List elements are
+// skipped too, since a diff cannot tell an insertion from an overwrite. Finding every conflict diffs every change, so it
+// is meant for debugging rather than for every request. Callers that check for conflicts as changes arrive should only
+// look for the ones that the changes since the last check take part in.
+package conflicts
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/docdiff"
+	"github.com/astromechza/automerge-experiments/pkg/hlc"
+)
+
+// Value is one of the competing values of a conflict and the change that wrote it.
+type Value struct {
+	Value  interface{} `json:"value"`
+	Actor  string      `json:"actor"`
+	Change string      `json:"change"`
+	Time   time.Time   `json:"time"`
+	// Clock is the hybrid logical clock timestamp of the change, or its wall clock time if it has none.
+	Clock hlc.Timestamp `json:"hlc"`
+	// Winner is set on the value the document currently shows.
+	Winner bool `json:"winner"`
+}
+
+type Conflict struct {
+	Path   []interface{} `json:"path"`
+	Values []Value       `json:"values"`
+}
+
+type write struct {
+	change int
+	value  interface{}
+	// deleted writes remove the key, they compete with nothing but still replace what they have seen
+	deleted bool
+}
+
+// ancestry answers whether one change has another in its history.
+type ancestry struct {
+	seen [][]uint64
+}
+
+// newAncestry indexes the history of the changes. The changes may be part of the history, as long as it holds every
+// change between any two of them, since the dependencies outside it are left out.
+func newAncestry(changes []*automerge.Change, partial bool) (*ancestry, error) {
+	index := make(map[automerge.ChangeHash]int, len(changes))
+	words := (len(changes) + 63) / 64
+	a := &ancestry{seen: make([][]uint64, len(changes))}
+	// doc.Changes lists changes after their dependencies, so each change's history is complete when it is reached
+	for i, change := range changes {
+		index[change.Hash()] = i
+		a.seen[i] = make([]uint64, words)
+		for _, dep := range change.Dependencies() {
+			j, ok := index[dep]
+			if !ok && partial {
+				continue
+			} else if !ok {
+				return nil, fmt.Errorf("change %s comes before its dependency %s", change.Hash(), dep)
+			}
+			a.seen[i][j/64] |= 1 << (j % 64)
+			for w := range a.seen[j] {
+				a.seen[i][w] |= a.seen[j][w]
+			}
+		}
+	}
+	return a, nil
+}
+
+// has returns true if the change i has the change j in its history.
+func (a *ancestry) has(i, j int) bool {
+	return a.seen[i][j/64]&(1<<(j%64)) != 0
+}
+
+// Find returns every path of the doc that currently has conflicting values, ordered by path. Given the heads of an
+// earlier version of the doc it only finds the conflicts that the changes made since then take part in.
+func Find(doc *automerge.Doc, since ...automerge.ChangeHash) ([]Conflict, error) {
+	changes, err := candidates(doc, since)
+	if err != nil {
+		return nil, err
+	}
+	history, err := newAncestry(changes, len(since) > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	writes := make(map[string][]write)
+	paths := make(map[string][]interface{})
+	for i, change := range changes {
+		patches, err := docdiff.DiffChange(doc, change)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range patches {
+			key := docdiff.PathString(p.Path)
+			paths[key] = p.Path
+			writes[key] = append(writes[key], write{change: i, value: p.After, deleted: p.After == nil})
+		}
+	}
+
+	out := make([]Conflict, 0)
+	for key, ws := range writes {
+		competing := make([]write, 0, len(ws))
+		for _, w := range ws {
+			if w.deleted {
+				continue
+			}
+			replaced := false
+			for _, other := range ws {
+				if other.change != w.change && history.has(other.change, w.change) {
+					replaced = true
+					break
+				}
+			}
+			if !replaced {
+				competing = append(competing, w)
+			}
+		}
+		if len(competing) < 2 {
+			continue
+		}
+		conflict, ok, err := newConflict(doc, changes, paths[key], competing)
+		if err != nil {
+			return nil, err
+		} else if ok {
+			out = append(out, conflict)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return docdiff.PathString(out[i].Path) < docdiff.PathString(out[j].Path)
+	})
+	return out, nil
+}
+
+// candidates returns the changes that may write a value competing with one written since the heads, in the order of
+// the doc's history. A change competes with a newer one only if the newer one has not seen it, so those are the changes
+// missing from the history of a newer change's dependencies. With no heads it returns the whole history.
+func candidates(doc *automerge.Doc, since []automerge.ChangeHash) ([]*automerge.Change, error) {
+	all, err := doc.Changes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changes: %w", err)
+	} else if len(since) == 0 {
+		return all, nil
+	}
+	newer, err := doc.Changes(since...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list changes since %v: %w", since, err)
+	}
+	keep := make(map[automerge.ChangeHash]bool)
+	for _, change := range newer {
+		unseen, err := doc.Changes(change.Dependencies()...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list changes unseen by %s: %w", change.Hash(), err)
+		}
+		for _, c := range unseen {
+			keep[c.Hash()] = true
+		}
+	}
+	out := make([]*automerge.Change, 0, len(keep))
+	for _, change := range all {
+		if keep[change.Hash()] {
+			out = append(out, change)
+		}
+	}
+	return out, nil
+}
+
+// newConflict describes the competing writes to the path, unless the current value there is one that merges instead.
+func newConflict(doc *automerge.Doc, changes []*automerge.Change, path []interface{}, competing []write) (Conflict, bool, error) {
+	current, err := doc.Path(path...).Get()
+	if err != nil {
+		return Conflict{}, false, fmt.Errorf("failed to get %s: %w", docdiff.PathString(path), err)
+	}
+	switch current.Kind() {
+	case automerge.KindVoid, automerge.KindText, automerge.KindCounter:
+		return Conflict{}, false, nil
+	}
+	if len(path) > 0 {
+		if parent, err := doc.Path(path[:len(path)-1]...).Get(); err != nil {
+			return Conflict{}, false, fmt.Errorf("failed to get parent of %s: %w", docdiff.PathString(path), err)
+		} else if parent.Kind() == automerge.KindList {
+			return Conflict{}, false, nil
+		}
+	}
+	// peers that concurrently wrote the same value agree, so there is nothing to show
+	agree := true
+	for _, w := range competing[1:] {
+		agree = agree && reflect.DeepEqual(w.value, competing[0].value)
+	}
+	if agree {
+		return Conflict{}, false, nil
+	}
+	winner, err := docdiff.Materialize(current)
+	if err != nil {
+		return Conflict{}, false, err
+	}
+
+	c := Conflict{Path: path, Values: make([]Value, 0, len(competing))}
+	won := false
+	for _, w := range competing {
+		change := changes[w.change]
+		v := Value{Value: w.value, Actor: change.ActorID(), Change: change.Hash().String(), Time: change.Timestamp(), Clock: hlc.FromChange(change)}
+		if !won && reflect.DeepEqual(w.value, winner) {
+			v.Winner, won = true, true
+		}
+		c.Values = append(c.Values, v)
+	}
+	return c, true, nil
+}
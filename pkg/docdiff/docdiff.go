@@ -0,0 +1,170 @@
+package docdiff
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/automerge/automerge-go"
+)
+
+// Patch describes a single path whose value differs between two versions of a document. Before is nil when the path
+// was created and After is nil when it was deleted.
+type Patch struct {
+	Path   []interface{}
+	Before interface{}
+	After  interface{}
+}
+
+// PathString renders a path like "tasks/abc/title" for logging and pattern matching.
+func PathString(path []interface{}) string {
+	parts := make([]string, len(path))
+	for i, p := range path {
+		parts[i] = fmt.Sprint(p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Materialize converts the value into plain Go types: map[string]interface{}, []interface{}, text and counters become
+// string and int64, and scalars are returned as is.
+func Materialize(v *automerge.Value) (interface{}, error) {
+	switch v.Kind() {
+	case automerge.KindMap:
+		values, err := v.Map().Values()
+		if err != nil {
+			return nil, err
+		}
+		out := make(map[string]interface{}, len(values))
+		for k, item := range values {
+			if out[k], err = Materialize(item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case automerge.KindList:
+		values, err := v.List().Values()
+		if err != nil {
+			return nil, err
+		}
+		out := make([]interface{}, len(values))
+		for i, item := range values {
+			if out[i], err = Materialize(item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case automerge.KindText:
+		return v.Text().Get()
+	case automerge.KindCounter:
+		return v.Counter().Get()
+	case automerge.KindVoid:
+		return nil, nil
+	default:
+		return v.Interface(), nil
+	}
+}
+
+// MaterializeDoc returns the whole document as plain Go types.
+func MaterializeDoc(doc *automerge.Doc) (map[string]interface{}, error) {
+	raw, err := Materialize(doc.Root())
+	if err != nil {
+		return nil, err
+	}
+	out, _ := raw.(map[string]interface{})
+	if out == nil {
+		out = make(map[string]interface{})
+	}
+	return out, nil
+}
+
+// Diff returns the patches that turn the before version into the after version. Maps are compared key by key and
+// lists index by index, so an insertion in the middle of a list shows up as a change to every following index.
+func Diff(before, after *automerge.Doc) ([]Patch, error) {
+	b, err := MaterializeDoc(before)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read before: %w", err)
+	}
+	a, err := MaterializeDoc(after)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read after: %w", err)
+	}
+	return DiffValues(nil, b, a), nil
+}
+
+// DiffChange returns the patches made by a single change of the document, by comparing the document at its
+// dependencies to the document just after it.
+func DiffChange(doc *automerge.Doc, change *automerge.Change) ([]Patch, error) {
+	// Fork with no heads returns the current state, so the very first change must be compared to an empty doc
+	before := automerge.New()
+	if deps := change.Dependencies(); len(deps) > 0 {
+		var err error
+		if before, err = doc.Fork(deps...); err != nil {
+			return nil, fmt.Errorf("failed to checkout dependencies of %s: %w", change.Hash(), err)
+		}
+	}
+	after, err := doc.Fork(change.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("failed to checkout %s: %w", change.Hash(), err)
+	}
+	return Diff(before, after)
+}
+
+// DiffValues compares two materialized values rooted at the given path. A map or list that is created or deleted is
+// treated as an empty one, so that the patches always describe the leaf values.
+func DiffValues(path []interface{}, before, after interface{}) []Patch {
+	before, after = emptyLike(before, after), emptyLike(after, before)
+	bm, bIsMap := before.(map[string]interface{})
+	am, aIsMap := after.(map[string]interface{})
+	if bIsMap && aIsMap {
+		out := make([]Patch, 0)
+		for k, bv := range bm {
+			out = append(out, DiffValues(appendPath(path, k), bv, am[k])...)
+		}
+		for k, av := range am {
+			if _, ok := bm[k]; !ok {
+				out = append(out, DiffValues(appendPath(path, k), nil, av)...)
+			}
+		}
+		return out
+	}
+	bl, bIsList := before.([]interface{})
+	al, aIsList := after.([]interface{})
+	if bIsList && aIsList {
+		out := make([]Patch, 0)
+		for i := 0; i < len(bl) || i < len(al); i++ {
+			var bv, av interface{}
+			if i < len(bl) {
+				bv = bl[i]
+			}
+			if i < len(al) {
+				av = al[i]
+			}
+			out = append(out, DiffValues(appendPath(path, i), bv, av)...)
+		}
+		return out
+	}
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	return []Patch{{Path: path, Before: before, After: after}}
+}
+
+// emptyLike returns an empty container of the same kind as other if v is nil.
+func emptyLike(v, other interface{}) interface{} {
+	if v != nil {
+		return v
+	}
+	switch other.(type) {
+	case map[string]interface{}:
+		return map[string]interface{}{}
+	case []interface{}:
+		return []interface{}{}
+	}
+	return nil
+}
+
+func appendPath(path []interface{}, next interface{}) []interface{} {
+	out := make([]interface{}, len(path), len(path)+1)
+	copy(out, path)
+	return append(out, next)
+}
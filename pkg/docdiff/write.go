@@ -0,0 +1,96 @@
+package docdiff
+
+import (
+	"slices"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/codec"
+)
+
+// Unit returns the path that is written as a whole for a changed leaf: the root of a map that was created or deleted,
+// a whole list since its indexes shift, or the leaf itself.
+func Unit(before, after *automerge.Doc, path []interface{}) ([]interface{}, error) {
+	for i := 1; i <= len(path); i++ {
+		if _, isIndex := path[i-1].(int); isIndex {
+			return path[:i-1], nil
+		}
+		b, err := before.Path(path[:i]...).Get()
+		if err != nil {
+			return nil, err
+		}
+		a, err := after.Path(path[:i]...).Get()
+		if err != nil {
+			return nil, err
+		}
+		if b.IsVoid() || a.IsVoid() {
+			return path[:i], nil
+		}
+	}
+	return path, nil
+}
+
+// Restore writes a copy of v at the path, replacing the current value, which is nil inside a value being restored.
+func Restore(doc *automerge.Doc, path []interface{}, v, current *automerge.Value) error {
+	p := doc.Path(path...)
+	switch v.Kind() {
+	case automerge.KindVoid:
+		if current == nil || current.IsVoid() {
+			return nil
+		}
+		return p.Delete()
+	case automerge.KindText:
+		s, err := v.Text().Get()
+		if err != nil {
+			return err
+		}
+		if current != nil && current.Kind() == automerge.KindText {
+			_, err = codec.UpdateText(current.Text(), s)
+			return err
+		}
+		return p.Set(automerge.NewText(s))
+	case automerge.KindCounter:
+		n, err := v.Counter().Get()
+		if err != nil {
+			return err
+		}
+		return p.Set(automerge.NewCounter(n))
+	case automerge.KindMap:
+		if err := p.Set(automerge.NewMap()); err != nil {
+			return err
+		}
+		values, err := v.Map().Values()
+		if err != nil {
+			return err
+		}
+		for k, item := range values {
+			if err := Restore(doc, append(slices.Clip(path), k), item, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	case automerge.KindList:
+		if err := p.Set(automerge.NewList()); err != nil {
+			return err
+		}
+		values, err := v.List().Values()
+		if err != nil {
+			return err
+		}
+		list, err := p.Get()
+		if err != nil {
+			return err
+		}
+		for i, item := range values {
+			if err := list.List().Append(nil); err != nil {
+				return err
+			}
+			if err := Restore(doc, append(slices.Clip(path), i), item, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return p.Set(v.Interface())
+	}
+}
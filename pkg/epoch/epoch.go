@@ -0,0 +1,227 @@
+// Package epoch compacts the history of a document by starting it again from its current state.
+//
+// Automerge keeps every change a document has ever had, and a new peer downloads all of them, so a long lived document
+// grows without bound. Starting a new epoch materializes the current state into a fresh document as a single change,
+// and records the number of the epoch and the final heads of the document it came from under Key. The old document is
+// then archived rather than synced any further. The new epoch shares no history with it, so merging the two would give
+// every value twice.
+//
+// A peer that still holds the old epoch must not sync it with the new one. Instead it fetches the archive of its epoch,
+// and Forward writes whatever it has that the archive lacks onto the new epoch as new changes of its own.
+package epoch
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+	"github.com/astromechza/automerge-experiments/pkg/docdiff"
+)
+
+// Key is the root map of the doc that records its epoch.
+const Key = "_epoch"
+
+// Info is the epoch of a doc.
+type Info struct {
+	// Number counts the epochs, a doc that was never compacted is epoch 0.
+	Number int `json:"number"`
+	// Previous is the final heads of the previous epoch, that this one started from.
+	Previous []string `json:"previous,omitempty"`
+}
+
+// Of returns the epoch of the doc.
+func Of(doc *automerge.Doc) (Info, error) {
+	v, err := doc.Path(Key).Get()
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to get epoch: %w", err)
+	} else if v.IsVoid() {
+		return Info{}, nil
+	} else if v.Kind() != automerge.KindMap {
+		return Info{}, fmt.Errorf("epoch is a %s", v.Kind())
+	}
+	var info Info
+	if n, err := v.Map().Get("number"); err != nil {
+		return Info{}, fmt.Errorf("failed to get epoch number: %w", err)
+	} else if n.Kind() == automerge.KindInt64 {
+		info.Number = int(n.Int64())
+	}
+	if p, err := v.Map().Get("previous"); err != nil {
+		return Info{}, fmt.Errorf("failed to get previous heads: %w", err)
+	} else if p.Kind() == automerge.KindList {
+		values, err := p.List().Values()
+		if err != nil {
+			return Info{}, fmt.Errorf("failed to get previous heads: %w", err)
+		}
+		for _, h := range values {
+			if h.Kind() == automerge.KindStr {
+				info.Previous = append(info.Previous, h.Str())
+			}
+		}
+	}
+	return info, nil
+}
+
+// Has returns true if the doc holds every one of the changes.
+func Has(doc *automerge.Doc, heads []automerge.ChangeHash) bool {
+	for _, h := range heads {
+		if _, err := doc.Change(h); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Start writes the current state of the doc onto base as the first change of the next epoch, and returns base. Base is
+// what every peer creates for itself in an empty doc, such as the genesis of a schema, so that a new peer's doc merges
+// with the new epoch instead of conflicting with it. It may be an empty doc.
+//
+// The change is made by an actor derived from the heads of the doc, with a fixed time, so starting the next epoch from
+// the same state always produces the same change.
+func Start(doc, base *automerge.Doc) (*automerge.Doc, error) {
+	info, err := Of(doc)
+	if err != nil {
+		return nil, err
+	}
+	// the state is read from a fork so that the heads recorded are exactly the ones that were copied
+	old, err := doc.Fork()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fork doc: %w", err)
+	}
+	from, err := base.Fork()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fork base: %w", err)
+	}
+	number, heads := info.Number+1, old.Heads()
+	if err := base.SetActorID(changehash.Actor(fmt.Sprintf("epoch:%d", number), heads)); err != nil {
+		return nil, fmt.Errorf("failed to set epoch actor: %w", err)
+	}
+	if _, err := write(base, from, old); err != nil {
+		return nil, err
+	}
+
+	if err := base.Path(Key).Set(automerge.NewMap()); err != nil {
+		return nil, fmt.Errorf("failed to record epoch: %w", err)
+	} else if err := base.Path(Key, "number").Set(int64(number)); err != nil {
+		return nil, fmt.Errorf("failed to record epoch: %w", err)
+	} else if err := base.Path(Key, "previous").Set(automerge.NewList()); err != nil {
+		return nil, fmt.Errorf("failed to record epoch: %w", err)
+	}
+	previous := changehash.Encode(heads)
+	for _, h := range previous {
+		if err := base.Path(Key, "previous").List().Append(h); err != nil {
+			return nil, fmt.Errorf("failed to record previous heads: %w", err)
+		}
+	}
+	fixed := time.UnixMilli(0)
+	if _, err := base.Commit(fmt.Sprintf("start epoch %d from %s", number, strings.Join(previous, ", ")), automerge.CommitOptions{Time: &fixed, AllowEmpty: true}); err != nil {
+		return nil, fmt.Errorf("failed to commit epoch: %w", err)
+	}
+	return base, nil
+}
+
+// Forward writes the edits that the local doc has and the archive of its epoch lacks onto next, and returns the paths
+// it changed. The archive is the doc that the epoch after it was started from, and next is that epoch or a later one.
+// The operations are left pending, for the caller to commit as the local actor.
+//
+// Edits are carried over as values, the same way undo reverts them: a changed key is set on next unless the map it
+// was in has been deleted there, text is spliced, counters are incremented by the same amount, and a changed list is
+// replaced as a whole.
+func Forward(next, archive, local *automerge.Doc) ([]string, error) {
+	if Has(archive, local.Heads()) {
+		return nil, nil
+	}
+	archiveInfo, err := Of(archive)
+	if err != nil {
+		return nil, err
+	}
+	localInfo, err := Of(local)
+	if err != nil {
+		return nil, err
+	}
+	if archiveInfo.Number != localInfo.Number {
+		return nil, fmt.Errorf("archive is of epoch %d but the doc is of epoch %d", archiveInfo.Number, localInfo.Number)
+	}
+	merged, err := archive.Fork()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fork archive: %w", err)
+	}
+	if _, err := merged.Merge(local); err != nil {
+		return nil, fmt.Errorf("failed to merge local changes: %w", err)
+	}
+	return write(next, archive, merged)
+}
+
+// write makes the changes from one version of a doc to another on the dst doc, and returns the paths it changed.
+func write(dst, from, to *automerge.Doc) ([]string, error) {
+	patches, err := docdiff.Diff(from, to)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	changed := make([]string, 0)
+	for _, p := range patches {
+		// each epoch records itself
+		if len(p.Path) > 0 && p.Path[0] == Key {
+			continue
+		}
+		path, err := docdiff.Unit(from, to, p.Path)
+		if err != nil {
+			return nil, err
+		}
+		key := docdiff.PathString(path)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if ok, err := writePath(dst, from, to, path); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", key, err)
+		} else if ok {
+			changed = append(changed, key)
+		}
+	}
+	slices.Sort(changed)
+	return changed, nil
+}
+
+// writePath writes the value at the path in to onto dst, and returns false if its parent no longer exists there.
+func writePath(dst, from, to *automerge.Doc, path []interface{}) (bool, error) {
+	if len(path) > 1 {
+		parent, err := dst.Path(path[:len(path)-1]...).Get()
+		if err != nil {
+			return false, err
+		} else if parent.IsVoid() {
+			return false, nil
+		}
+	}
+	fv, err := from.Path(path...).Get()
+	if err != nil {
+		return false, err
+	}
+	tv, err := to.Path(path...).Get()
+	if err != nil {
+		return false, err
+	}
+	cv, err := dst.Path(path...).Get()
+	if err != nil {
+		return false, err
+	}
+	// increments made on dst in the meantime are kept by incrementing rather than setting the counter
+	if tv.Kind() == automerge.KindCounter && cv.Kind() == automerge.KindCounter {
+		t, err := tv.Counter().Get()
+		if err != nil {
+			return false, err
+		}
+		f := int64(0)
+		if fv.Kind() == automerge.KindCounter {
+			if f, err = fv.Counter().Get(); err != nil {
+				return false, err
+			}
+		}
+		return true, cv.Counter().Inc(t - f)
+	}
+	return true, docdiff.Restore(dst, path, tv, cv)
+}
@@ -0,0 +1,191 @@
+// Package handle wraps a document so that code can subscribe to its changes.
+//
+// A Handle is the lock that every reader and writer of the document holds, including the sync, see pkg.Hooks.DocLock.
+// When the lock is released after the document changed, the handle diffs the document against what it last saw and
+// delivers the patches to the subscribers whose path prefix they fall under. Local edits and changes merged from peers
+// are reported the same way, since both happen under the lock.
+//
+// Patches are computed with docdiff, so they describe leaf values: a created map is reported as the values inside it,
+// and a text edit as the new value of the whole text.
+package handle
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/docdiff"
+)
+
+type Op string
+
+const (
+	// OpSet means the path was created or given a new value
+	OpSet Op = "set"
+	// OpDelete means the path was removed
+	OpDelete Op = "delete"
+)
+
+// Patch is a change to a single path of the document. Value is the new value of a set, in the plain types of
+// docdiff.Materialize.
+type Patch struct {
+	Op    Op            `json:"op"`
+	Path  []interface{} `json:"path"`
+	Value interface{}   `json:"value,omitempty"`
+}
+
+func (p Patch) String() string {
+	if p.Op == OpDelete {
+		return fmt.Sprintf("delete %s", docdiff.PathString(p.Path))
+	}
+	return fmt.Sprintf("set %s = %v", docdiff.PathString(p.Path), p.Value)
+}
+
+type subscriber struct {
+	prefix []interface{}
+	fn     func([]Patch)
+}
+
+type Handle struct {
+	lock sync.Mutex
+	doc  *automerge.Doc
+	// heads and snapshot are the state the subscribers were last told about
+	heads    []automerge.ChangeHash
+	snapshot map[string]interface{}
+
+	// queueLock guards the deliveries, which happen outside of the doc lock so that subscribers can read the doc
+	queueLock   sync.Mutex
+	subscribers map[int]subscriber
+	nextID      int
+	queue       [][]Patch
+	delivering  bool
+}
+
+func New(doc *automerge.Doc) (*Handle, error) {
+	snapshot, err := docdiff.MaterializeDoc(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &Handle{doc: doc, heads: doc.Heads(), snapshot: snapshot, subscribers: make(map[int]subscriber)}, nil
+}
+
+// Doc returns the document. Only use it while holding the lock.
+func (h *Handle) Doc() *automerge.Doc {
+	return h.doc
+}
+
+func (h *Handle) Lock() {
+	h.lock.Lock()
+}
+
+// Unlock releases the doc, and if it changed while locked, delivers the patches to the subscribers. Subscribers are
+// called one batch at a time in the order of the changes, from whichever goroutine is delivering at the time, and may
+// lock the handle themselves.
+func (h *Handle) Unlock() {
+	patches, changed := h.diff()
+	if changed {
+		h.queueLock.Lock()
+		h.queue = append(h.queue, patches)
+		h.queueLock.Unlock()
+	}
+	h.lock.Unlock()
+	if changed {
+		h.deliver()
+	}
+}
+
+// diff compares the doc with the snapshot, while the lock is held.
+func (h *Handle) diff() ([]Patch, bool) {
+	heads := h.doc.Heads()
+	if slices.Equal(heads, h.heads) {
+		return nil, false
+	}
+	snapshot, err := docdiff.MaterializeDoc(h.doc)
+	if err != nil {
+		// the doc was readable when the change was made, so this only happens if it is corrupt
+		slog.Error("failed to read doc for subscribers", "err", err)
+		return nil, false
+	}
+	diffs := docdiff.DiffValues(nil, h.snapshot, snapshot)
+	h.heads, h.snapshot = heads, snapshot
+	patches := make([]Patch, len(diffs))
+	for i, d := range diffs {
+		patches[i] = Patch{Op: OpSet, Path: d.Path, Value: d.After}
+		if d.After == nil {
+			patches[i] = Patch{Op: OpDelete, Path: d.Path}
+		}
+	}
+	slices.SortFunc(patches, func(a, b Patch) int {
+		return strings.Compare(docdiff.PathString(a.Path), docdiff.PathString(b.Path))
+	})
+	return patches, true
+}
+
+// deliver drains the queue. If a delivery is already running, possibly further up this goroutine's stack, it leaves
+// the new batch to that one.
+func (h *Handle) deliver() {
+	h.queueLock.Lock()
+	if h.delivering {
+		h.queueLock.Unlock()
+		return
+	}
+	h.delivering = true
+	for len(h.queue) > 0 {
+		patches := h.queue[0]
+		h.queue = h.queue[1:]
+		subscribers := make([]subscriber, 0, len(h.subscribers))
+		for _, s := range h.subscribers {
+			subscribers = append(subscribers, s)
+		}
+		h.queueLock.Unlock()
+		for _, s := range subscribers {
+			if matching := filter(patches, s.prefix); len(matching) > 0 {
+				s.fn(matching)
+			}
+		}
+		h.queueLock.Lock()
+	}
+	h.delivering = false
+	h.queueLock.Unlock()
+}
+
+func hasPrefix(path, prefix []interface{}) bool {
+	if len(path) < len(prefix) {
+		return false
+	}
+	for i, p := range prefix {
+		if fmt.Sprint(p) != fmt.Sprint(path[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func filter(patches []Patch, prefix []interface{}) []Patch {
+	out := make([]Patch, 0, len(patches))
+	for _, p := range patches {
+		if hasPrefix(p.Path, prefix) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Subscribe calls fn with the patches under the path prefix each time the doc changes, or with every patch if the
+// prefix is empty. It returns a function that ends the subscription.
+func (h *Handle) Subscribe(fn func([]Patch), prefix ...interface{}) func() {
+	h.queueLock.Lock()
+	defer h.queueLock.Unlock()
+	id := h.nextID
+	h.nextID++
+	h.subscribers[id] = subscriber{prefix: prefix, fn: fn}
+	return func() {
+		h.queueLock.Lock()
+		defer h.queueLock.Unlock()
+		delete(h.subscribers, id)
+	}
+}
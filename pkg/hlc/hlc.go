@@ -0,0 +1,169 @@
+// Package hlc implements hybrid logical clocks.
+//
+// A hybrid logical clock reads like wall clock time in milliseconds, but never goes backwards and always moves past
+// any timestamp it has seen from another peer. Two events ordered by causality are therefore ordered by their
+// timestamps even when the devices' clocks disagree, while unrelated events are still roughly ordered by when they
+// happened.
+//
+// Timestamps travel in automerge commit messages as a trailer line, see Stamp and FromChange.
+package hlc
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+)
+
+// trailer starts the line of a commit message that holds its timestamp.
+const trailer = "hlc: "
+
+// DefaultMaxOffset is how far ahead of the local clock a remote timestamp may be before it is ignored, so that one
+// device with a badly wrong clock cannot drag everyone else's clocks into the future.
+const DefaultMaxOffset = time.Hour
+
+// Timestamp is a point on a hybrid logical clock: wall clock milliseconds and a counter for events within the same
+// millisecond.
+type Timestamp struct {
+	Wall    int64
+	Logical uint32
+}
+
+func (t Timestamp) IsZero() bool {
+	return t.Wall == 0 && t.Logical == 0
+}
+
+// Time returns the wall clock part of the timestamp.
+func (t Timestamp) Time() time.Time {
+	return time.UnixMilli(t.Wall)
+}
+
+// Compare returns -1, 0 or 1 as t is before, equal to or after other.
+func (t Timestamp) Compare(other Timestamp) int {
+	switch {
+	case t.Wall < other.Wall:
+		return -1
+	case t.Wall > other.Wall:
+		return 1
+	case t.Logical < other.Logical:
+		return -1
+	case t.Logical > other.Logical:
+		return 1
+	}
+	return 0
+}
+
+// String formats the timestamp with fixed widths, so that timestamps sort the same as strings.
+func (t Timestamp) String() string {
+	return fmt.Sprintf("%013d.%06d", t.Wall, t.Logical)
+}
+
+func Parse(s string) (Timestamp, error) {
+	var t Timestamp
+	if _, err := fmt.Sscanf(s, "%d.%d", &t.Wall, &t.Logical); err != nil {
+		return Timestamp{}, fmt.Errorf("invalid hybrid logical clock timestamp %q: %w", s, err)
+	}
+	return t, nil
+}
+
+func (t Timestamp) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *Timestamp) UnmarshalText(raw []byte) error {
+	parsed, err := Parse(string(raw))
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+// Clock issues timestamps for one peer. It is safe for concurrent use.
+type Clock struct {
+	lock sync.Mutex
+	last Timestamp
+	// Physical reads the wall clock, it is replaced in tests
+	Physical  func() time.Time
+	MaxOffset time.Duration
+}
+
+func New() *Clock {
+	return &Clock{Physical: time.Now, MaxOffset: DefaultMaxOffset}
+}
+
+// Now returns a timestamp for a local event, after every timestamp the clock has issued or seen.
+func (c *Clock) Now() Timestamp {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	physical := c.Physical().UnixMilli()
+	if physical > c.last.Wall {
+		c.last = Timestamp{Wall: physical}
+	} else {
+		c.last.Logical++
+	}
+	return c.last
+}
+
+// Update moves the clock past a timestamp received from another peer. It returns false and ignores the timestamp if it
+// is more than MaxOffset ahead of the local wall clock.
+func (c *Clock) Update(remote Timestamp) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	physical := c.Physical()
+	if c.MaxOffset > 0 && remote.Time().After(physical.Add(c.MaxOffset)) {
+		return false
+	}
+	if remote.Compare(c.last) > 0 {
+		c.last = remote
+	}
+	return true
+}
+
+// Stamp adds the timestamp to a commit message as a trailer line.
+func Stamp(msg string, t Timestamp) string {
+	return msg + "\n\n" + trailer + t.String()
+}
+
+// FromMessage returns the timestamp in the trailer of the commit message, if it has one.
+func FromMessage(msg string) (Timestamp, bool) {
+	i := strings.LastIndex(msg, "\n"+trailer)
+	if i < 0 {
+		return Timestamp{}, false
+	}
+	t, err := Parse(strings.TrimSpace(msg[i+1+len(trailer):]))
+	return t, err == nil
+}
+
+// FromChange returns the timestamp of the change, falling back to its wall clock time for changes made without a
+// hybrid logical clock.
+func FromChange(change *automerge.Change) Timestamp {
+	if t, ok := FromMessage(change.Message()); ok {
+		return t
+	}
+	return Timestamp{Wall: change.Timestamp().UnixMilli()}
+}
+
+// Observe moves the clock past every change of the doc after the given heads, and returns how many it had to ignore
+// for being too far in the future. Call it after receiving changes from other peers.
+func (c *Clock) Observe(doc *automerge.Doc, since ...automerge.ChangeHash) (int, error) {
+	changes, err := doc.Changes(since...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list changes: %w", err)
+	}
+	return c.ObserveChanges(changes), nil
+}
+
+// ObserveChanges moves the clock past the changes, such as those of a sync message as it is received, and returns how
+// many it had to ignore for being too far in the future.
+func (c *Clock) ObserveChanges(changes []*automerge.Change) int {
+	ignored := 0
+	for _, change := range changes {
+		if t, ok := FromMessage(change.Message()); ok && !c.Update(t) {
+			ignored++
+		}
+	}
+	return ignored
+}
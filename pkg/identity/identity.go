@@ -0,0 +1,201 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/automerge/automerge-go"
+)
+
+// signaturePrefix separates change signatures from any other use of the same key.
+const signaturePrefix = "automerge-change:"
+
+// sessionPrefix separates session proofs from any other use of the same key.
+const sessionPrefix = "automerge-session:"
+
+// Device is the persistent identity of a single device. Its actor id is derived from its public key, so a signature
+// from the key proves who authored a change. Since automerge requires each actor's changes to form a single sequence,
+// only one process may use a device key at a time, which LoadOrCreate enforces with a lock next to the key.
+type Device struct {
+	privateKey ed25519.PrivateKey
+	lock       *os.File
+	created    bool
+}
+
+// DefaultPath returns the location of the device key in the user's config directory.
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find config dir: %w", err)
+	}
+	return filepath.Join(dir, "automerge-experiments", "device.key"), nil
+}
+
+// LoadOrCreate locks the device key at the path and reads it, or generates and writes a new one if it does not exist.
+// It fails if another process holds the key, since two processes writing as the same actor would give different
+// changes the same sequence number. The lock is held until Close.
+func LoadOrCreate(path string) (*Device, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create device key dir: %w", err)
+	}
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open device key lock: %w", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		_ = lock.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("device key %s is in use by another process, use -identity to give this one its own", path)
+		}
+		return nil, fmt.Errorf("failed to lock device key: %w", err)
+	}
+	d, err := readOrCreate(path)
+	if err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	d.lock = lock
+	return d, nil
+}
+
+func readOrCreate(path string) (*Device, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate device key: %w", err)
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(privateKey.Seed())+"\n"), 0o600); err != nil {
+			return nil, fmt.Errorf("failed to write device key: %w", err)
+		}
+		return &Device{privateKey: privateKey, created: true}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read device key: %w", err)
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("device key in %s is not a hex encoded ed25519 seed", path)
+	}
+	return &Device{privateKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// Created returns true if LoadOrCreate generated the key, in which case no change has been written by it yet.
+func (d *Device) Created() bool {
+	return d.created
+}
+
+// Close releases the lock on the device key.
+func (d *Device) Close() error {
+	if d.lock == nil {
+		return nil
+	}
+	return d.lock.Close()
+}
+
+func (d *Device) PublicKey() ed25519.PublicKey {
+	return d.privateKey.Public().(ed25519.PublicKey)
+}
+
+func (d *Device) ActorID() string {
+	return ActorIDFor(d.PublicKey())
+}
+
+// ActorIDFor derives the automerge actor id for a public key.
+func ActorIDFor(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:16])
+}
+
+// Signature proves that the owner of PublicKey authored the change with the given hash.
+type Signature struct {
+	Hash      string `json:"hash"`
+	PublicKey []byte `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+func signedBytes(hash automerge.ChangeHash) []byte {
+	return append([]byte(signaturePrefix), hash[:]...)
+}
+
+// Sign signs the change hash.
+func (d *Device) Sign(hash automerge.ChangeHash) Signature {
+	return Signature{
+		Hash:      hash.String(),
+		PublicKey: d.PublicKey(),
+		Signature: ed25519.Sign(d.privateKey, signedBytes(hash)),
+	}
+}
+
+// Derived returns true if the change was made by an actor that belongs to no device, such as one derived with
+// changehash.Actor, since every peer makes the change the same way. A nil Derived matches nothing. Derived actors are
+// public, so a Derived used to verify changes must also check that the change is the one every peer would make.
+type Derived func(change *automerge.Change) bool
+
+func (f Derived) matches(change *automerge.Change) bool {
+	return f != nil && f(change)
+}
+
+// SignOwnChanges returns signatures for each of the changes authored by this device. Derived changes are signed too,
+// since this device may have made them, and the signature then records which device vouched for the change.
+func (d *Device) SignOwnChanges(changes []*automerge.Change, derived Derived) []Signature {
+	actor := d.ActorID()
+	out := make([]Signature, 0)
+	for _, change := range changes {
+		if change.ActorID() == actor || derived.matches(change) {
+			out = append(out, d.Sign(change.Hash()))
+		}
+	}
+	return out
+}
+
+// Verify checks that the signature is valid for the change and that the change's actor belongs to the signing key, or
+// that the change is derived.
+func (s Signature) Verify(change *automerge.Change, derived Derived) error {
+	if s.Hash != change.Hash().String() {
+		return fmt.Errorf("signature is for %s not %s", s.Hash, change.Hash())
+	}
+	if len(s.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key on signature of %s", s.Hash)
+	}
+	if actor := ActorIDFor(s.PublicKey); actor != change.ActorID() && !derived.matches(change) {
+		return fmt.Errorf("change %s was written by actor %s but signed by %s", s.Hash, change.ActorID(), actor)
+	}
+	if !ed25519.Verify(s.PublicKey, signedBytes(change.Hash()), s.Signature) {
+		return fmt.Errorf("bad signature on change %s", s.Hash)
+	}
+	return nil
+}
+
+// Proof shows that the owner of PublicKey is behind a sync session. It signs the id that the server gave the session,
+// so it cannot be replayed on another one.
+type Proof struct {
+	PublicKey []byte `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+// ProveSession signs the session id.
+func (d *Device) ProveSession(session string) Proof {
+	return Proof{
+		PublicKey: d.PublicKey(),
+		Signature: ed25519.Sign(d.privateKey, []byte(sessionPrefix+session)),
+	}
+}
+
+// Verify checks that the proof is for the session and returns the actor id of its key.
+func (p Proof) Verify(session string) (string, error) {
+	if len(p.PublicKey) != ed25519.PublicKeySize {
+		return "", fmt.Errorf("invalid public key on proof of session %s", session)
+	}
+	if !ed25519.Verify(p.PublicKey, []byte(sessionPrefix+session), p.Signature) {
+		return "", fmt.Errorf("bad proof of session %s", session)
+	}
+	return ActorIDFor(p.PublicKey), nil
+}
@@ -0,0 +1,55 @@
+package identity
+
+import (
+	"fmt"
+
+	"github.com/automerge/automerge-go"
+)
+
+// NamesKey is the root map of the doc that holds the display name of each actor, keyed by actor id.
+const NamesKey = "_actors"
+
+// SetName records the display name of the actor in the doc if it is not already recorded, and returns the message to
+// commit the change with, or an empty one if there is nothing to commit. Committing is left to the caller.
+//
+// If two peers create the names map concurrently only one of the maps survives the merge, so callers should call this
+// again after syncing to restore a name that was lost.
+func SetName(doc *automerge.Doc, actor, name string) (string, error) {
+	if name == "" || Names(doc)[actor] == name {
+		return "", nil
+	}
+	if err := doc.Path(NamesKey, actor).Set(name); err != nil {
+		return "", fmt.Errorf("failed to set display name: %w", err)
+	}
+	return fmt.Sprintf("set display name of %s to %q", actor, name), nil
+}
+
+// Names returns the display names recorded in the doc.
+func Names(doc *automerge.Doc) map[string]string {
+	out := make(map[string]string)
+	v, err := doc.Path(NamesKey).Get()
+	if err != nil || v.Kind() != automerge.KindMap {
+		return out
+	}
+	values, err := v.Map().Values()
+	if err != nil {
+		return out
+	}
+	for actor, name := range values {
+		if name.Kind() == automerge.KindStr {
+			out[actor] = name.Str()
+		}
+	}
+	return out
+}
+
+// Label returns the display name of the actor followed by a short form of its id, or the full id if it has no name.
+func Label(names map[string]string, actor string) string {
+	if name, ok := names[actor]; ok {
+		if len(actor) > 8 {
+			actor = actor[:8]
+		}
+		return fmt.Sprintf("%s (%s)", name, actor)
+	}
+	return actor
+}
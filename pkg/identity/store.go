@@ -0,0 +1,85 @@
+package identity
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/automerge/automerge-go"
+)
+
+// SignatureStore keeps the verified signature of each change so that authorship can be proven later.
+type SignatureStore struct {
+	database *sql.DB
+}
+
+func NewSignatureStore(database *sql.DB) *SignatureStore {
+	return &SignatureStore{database: database}
+}
+
+func (s *SignatureStore) Init() error {
+	if _, err := s.database.Exec(
+		`CREATE TABLE IF NOT EXISTS change_signatures (
+    	store_id text not null,
+    	hash text not null,
+    	actor text not null,
+    	public_key blob not null,
+    	signature blob not null,
+    	primary key (store_id, hash)
+		)`,
+	); err != nil {
+		return fmt.Errorf("failed to create change signatures table: %w", err)
+	}
+	return nil
+}
+
+// Put stores signatures that have already been verified. Signatures for changes that already have one are ignored.
+func (s *SignatureStore) Put(ctx context.Context, store string, signatures []Signature) error {
+	for _, sig := range signatures {
+		if _, err := s.database.ExecContext(
+			ctx, `INSERT OR IGNORE INTO change_signatures(store_id, hash, actor, public_key, signature) VALUES (?, ?, ?, ?, ?)`,
+			store, sig.Hash, ActorIDFor(sig.PublicKey), sig.PublicKey, sig.Signature,
+		); err != nil {
+			return fmt.Errorf("failed to store signature: %w", err)
+		}
+	}
+	return nil
+}
+
+// List returns all stored signatures of the store.
+func (s *SignatureStore) List(ctx context.Context, store string) ([]Signature, error) {
+	rows, err := s.database.QueryContext(ctx, `SELECT hash, public_key, signature FROM change_signatures WHERE store_id = ?`, store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query signatures: %w", err)
+	}
+	defer rows.Close()
+	out := make([]Signature, 0)
+	for rows.Next() {
+		var sig Signature
+		if err := rows.Scan(&sig.Hash, &sig.PublicKey, &sig.Signature); err != nil {
+			return nil, fmt.Errorf("failed to scan: %w", err)
+		}
+		out = append(out, sig)
+	}
+	return out, rows.Err()
+}
+
+// VerifyChanges checks the given signatures against the changes. Changes without a signature are an error if required
+// is set. Changes that derived accepts may be signed by any device, see Derived. The verified signatures are returned.
+func VerifyChanges(changes []*automerge.Change, signatures map[string]Signature, required bool, derived Derived) ([]Signature, error) {
+	out := make([]Signature, 0, len(changes))
+	for _, change := range changes {
+		sig, ok := signatures[change.Hash().String()]
+		if !ok {
+			if required {
+				return nil, fmt.Errorf("change %s by actor %s is not signed", change.Hash(), change.ActorID())
+			}
+			continue
+		}
+		if err := sig.Verify(change, derived); err != nil {
+			return nil, err
+		}
+		out = append(out, sig)
+	}
+	return out, nil
+}
@@ -0,0 +1,189 @@
+// Package mergepolicy overrides automerge's choice of winner for conflicting values at chosen paths.
+//
+// Automerge resolves a conflict by picking the value of the operation with the highest id, which is consistent on every
+// replica but unrelated to what the values mean. A Registry maps path patterns to policies that pick a different
+// winner. Resolve finds the conflicts, asks the matching policy for each, and writes the chosen values in a single
+// change that has every competing value in its history, which ends the conflict on every replica that receives it.
+//
+// Like migrations, the resolving change is made by an actor derived from the heads it starts from with a timestamp
+// derived from the conflict's clocks, so replicas that resolve the same state produce identical changes that deduplicate when
+// they sync. Replicas that resolve different states write the same values, which do not conflict. Since the change is
+// fixed by the heads it starts from, a peer can check one it receives by resolving those heads itself.
+package mergepolicy
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+	"github.com/astromechza/automerge-experiments/pkg/conflicts"
+	"github.com/astromechza/automerge-experiments/pkg/docdiff"
+	"github.com/astromechza/automerge-experiments/pkg/hlc"
+)
+
+// ActorLabel is the label of the actor derived for resolving changes, see changehash.Actor.
+const ActorLabel = "mergepolicy"
+
+// Policy picks the index of the value that should win the conflict, or returns false to leave automerge's choice. It
+// must be deterministic, since every replica resolves the conflict independently.
+type Policy func(c conflicts.Conflict) (int, bool)
+
+// Rule applies the policy to the paths matching the pattern, a "/" separated path where "*" matches any single
+// segment, for example "tasks/*/due". Unlike permission rules it matches exactly, not the children of the path.
+type Rule struct {
+	Path        string
+	Description string
+	Policy      Policy
+}
+
+type Registry struct {
+	Rules []Rule
+}
+
+func match(pattern []string, path []interface{}) bool {
+	if len(path) != len(pattern) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != fmt.Sprint(path[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// ruleFor returns the first rule that matches the path.
+func (r *Registry) ruleFor(path []interface{}) (Rule, bool) {
+	for _, rule := range r.Rules {
+		if match(strings.Split(rule.Path, "/"), path) {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// LastWriterWins picks the value with the latest hybrid logical clock timestamp. The clocks follow causality across
+// peers, but concurrent writes are still only ordered as well as the wall clocks of the writers agree. Ties keep
+// automerge's winner.
+func LastWriterWins(c conflicts.Conflict) (int, bool) {
+	best := -1
+	for i, v := range c.Values {
+		if best < 0 {
+			best = i
+		} else if cmp := v.Clock.Compare(c.Values[best].Clock); cmp > 0 || (cmp == 0 && v.Winner) {
+			best = i
+		}
+	}
+	return best, best >= 0
+}
+
+// Prefer returns a policy that picks the first of the values, in the given order, that is among the competing ones.
+// Since competing values were written concurrently, preferring "open" over "done" means a task is only done if the
+// completion came causally after every reopen.
+func Prefer(values ...interface{}) Policy {
+	return func(c conflicts.Conflict) (int, bool) {
+		for _, want := range values {
+			for i, v := range c.Values {
+				if reflect.DeepEqual(v.Value, want) {
+					return i, true
+				}
+			}
+		}
+		return 0, false
+	}
+}
+
+// isScalar is true for the materialized values that can be written back as they are.
+func isScalar(v interface{}) bool {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}, nil:
+		return false
+	}
+	return true
+}
+
+// pick returns the rule for the conflict and the index of the value it picks, or false if the conflict is left as it is.
+func (r *Registry) pick(c conflicts.Conflict) (Rule, int, bool) {
+	rule, ok := r.ruleFor(c.Path)
+	if !ok {
+		return Rule{}, 0, false
+	}
+	i, ok := rule.Policy(c)
+	if !ok || i < 0 || i >= len(c.Values) || c.Values[i].Winner || !isScalar(c.Values[i].Value) {
+		return Rule{}, 0, false
+	}
+	return rule, i, true
+}
+
+// Resolve applies the policies to the conflicts of the doc and returns the paths it changed. Given the heads of an
+// earlier version of the doc it only looks for work when the changes since then take part in a conflict that a policy
+// picks a new winner for, see conflicts.Find, so call it after merging in changes from elsewhere with the heads from
+// before the last call. The resolving change always covers every conflict of the doc, so that it depends only on the
+// heads: a derived actor making different changes from the same heads would clash, and a peer that receives the
+// change can check it by resolving the same heads itself.
+func (r *Registry) Resolve(doc *automerge.Doc, since ...automerge.ChangeHash) ([]string, error) {
+	found, err := conflicts.Find(doc, since...)
+	if err != nil {
+		return nil, err
+	}
+	if len(since) > 0 {
+		if !slices.ContainsFunc(found, func(c conflicts.Conflict) bool {
+			_, _, ok := r.pick(c)
+			return ok
+		}) {
+			return make([]string, 0), nil
+		}
+		if found, err = conflicts.Find(doc); err != nil {
+			return nil, err
+		}
+	}
+	heads := doc.Heads()
+	fork, err := doc.Fork()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fork doc: %w", err)
+	}
+	if err := fork.SetActorID(changehash.Actor(ActorLabel, heads)); err != nil {
+		return nil, fmt.Errorf("failed to set resolver actor: %w", err)
+	}
+	// the change is stamped with the latest competing clock, so a later last writer wins policy still sees it in order
+	var latest hlc.Timestamp
+	resolved := make([]string, 0)
+	descriptions := make([]string, 0)
+	for _, c := range found {
+		rule, i, ok := r.pick(c)
+		if !ok {
+			continue
+		}
+		if err := fork.Path(c.Path...).Set(c.Values[i].Value); err != nil {
+			return nil, fmt.Errorf("failed to set %s: %w", docdiff.PathString(c.Path), err)
+		}
+		for _, v := range c.Values {
+			if v.Clock.Compare(latest) > 0 {
+				latest = v.Clock
+			}
+		}
+		resolved = append(resolved, docdiff.PathString(c.Path))
+		if rule.Description != "" && !slices.Contains(descriptions, rule.Description) {
+			descriptions = append(descriptions, rule.Description)
+		}
+	}
+	if len(resolved) == 0 {
+		return resolved, nil
+	}
+	msg := fmt.Sprintf("resolve conflicts at %s", strings.Join(resolved, ", "))
+	if len(descriptions) > 0 {
+		msg += ": " + strings.Join(descriptions, ", ")
+	}
+	t := latest.Time()
+	if _, err := fork.Commit(hlc.Stamp(msg, latest), automerge.CommitOptions{Time: &t}); err != nil {
+		return nil, fmt.Errorf("failed to commit resolution: %w", err)
+	}
+	if _, err := doc.Merge(fork); err != nil {
+		return nil, fmt.Errorf("failed to merge resolution: %w", err)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,121 @@
+// Package migrate upgrades documents between schema versions.
+//
+// The version is stored in a root key of the doc, and each Migration moves the doc from one version to the next. Any
+// peer may migrate a doc, so migrations have to be safe to run on several peers at once:
+//
+//   - Each migration is committed by an actor derived from the target version and the heads it started from, with a
+//     fixed timestamp. Peers migrating the same state therefore produce byte-identical changes, which automerge
+//     deduplicates when they sync.
+//   - Peers that migrate different states produce different changes that are merged. Migrations should make keyed
+//     writes (set this key to that value) rather than inserts into lists or new random ids, so that the merged result
+//     matches what a single migration would have produced.
+//   - Apply must be deterministic: no clocks, randomness or map iteration order.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+)
+
+// ErrNewerVersion is returned when the doc was written by a newer schema than the registry knows about. Writing to it
+// could corrupt data that this peer does not understand.
+var ErrNewerVersion = errors.New("document has a newer schema version")
+
+type Migration struct {
+	// To is the version the migration produces, the first migration is to version 1.
+	To          int
+	Description string
+	Apply       func(doc *automerge.Doc) error
+}
+
+type Registry struct {
+	// VersionKey is the root key that holds the schema version. A doc without it is version 0.
+	VersionKey string
+	// Migrations must be in order, with the To of each being one more than the one before.
+	Migrations []Migration
+}
+
+// ActorLabel is the label of the actor derived for the migration to the version, see changehash.Actor.
+func ActorLabel(to int) string {
+	return fmt.Sprintf("migration:%d", to)
+}
+
+// ActorLabels returns the labels of the actors of every migration, for changehash.IsDerived.
+func (r *Registry) ActorLabels() []string {
+	out := make([]string, len(r.Migrations))
+	for i := range r.Migrations {
+		out[i] = ActorLabel(i + 1)
+	}
+	return out
+}
+
+// Latest returns the version that Migrate upgrades to.
+func (r *Registry) Latest() int {
+	return len(r.Migrations)
+}
+
+// Version returns the schema version of the doc.
+func (r *Registry) Version(doc *automerge.Doc) (int, error) {
+	v, err := doc.Path(r.VersionKey).Get()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get schema version: %w", err)
+	}
+	switch v.Kind() {
+	case automerge.KindVoid:
+		return 0, nil
+	case automerge.KindInt64:
+		return int(v.Int64()), nil
+	case automerge.KindUint64:
+		return int(v.Uint64()), nil
+	case automerge.KindFloat64:
+		return int(v.Float64()), nil
+	}
+	return 0, fmt.Errorf("schema version is a %s", v.Kind())
+}
+
+// Migrate applies each migration the doc has not had yet, and returns how many it applied. Each migration is a single
+// commit. If a migration fails the doc is left at the last successful version.
+func (r *Registry) Migrate(doc *automerge.Doc) (int, error) {
+	version, err := r.Version(doc)
+	if err != nil {
+		return 0, err
+	} else if version > r.Latest() {
+		return 0, fmt.Errorf("%w: %d is newer than %d", ErrNewerVersion, version, r.Latest())
+	}
+	epoch := time.UnixMilli(0)
+	applied := 0
+	for i, m := range r.Migrations {
+		if m.To != i+1 {
+			return applied, fmt.Errorf("migration %d is out of order, it migrates to %d", i, m.To)
+		} else if m.To <= version {
+			continue
+		}
+		// the migration runs on a fork so that a failure leaves no partial operations in the doc
+		fork, err := doc.Fork()
+		if err != nil {
+			return applied, fmt.Errorf("failed to fork doc: %w", err)
+		}
+		if err := fork.SetActorID(changehash.Actor(ActorLabel(m.To), doc.Heads())); err != nil {
+			return applied, fmt.Errorf("failed to set migration actor: %w", err)
+		}
+		if err := m.Apply(fork); err != nil {
+			return applied, fmt.Errorf("failed to migrate to version %d: %w", m.To, err)
+		}
+		if err := fork.Path(r.VersionKey).Set(int64(m.To)); err != nil {
+			return applied, fmt.Errorf("failed to set schema version: %w", err)
+		}
+		if _, err := fork.Commit(fmt.Sprintf("migrate schema to version %d: %s", m.To, m.Description), automerge.CommitOptions{Time: &epoch}); err != nil {
+			return applied, fmt.Errorf("failed to commit migration to version %d: %w", m.To, err)
+		}
+		if _, err := doc.Merge(fork); err != nil {
+			return applied, fmt.Errorf("failed to merge migration to version %d: %w", m.To, err)
+		}
+		applied++
+	}
+	return applied, nil
+}
@@ -0,0 +1,165 @@
+package perms
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/docdiff"
+)
+
+// Rule restricts who may modify the values at or below a path. The path is a "/" separated pattern where "*" matches
+// any single segment, for example "tasks/*/done". A change may modify a matching value if its actor is listed in
+// Actors, where "*" stands for any actor, or if its actor equals the value of ActorField, a sibling of the matched path,
+// before the change. A rule with neither makes the path immutable.
+//
+// The most specific rule that matches a value decides, and a store with rules refuses changes to values that no rule
+// matches, so the rules must list every path that peers write to. Anyone may create a value at a path that a rule
+// matches, the rule only applies once the value exists.
+type Rule struct {
+	Path        string   `json:"path"`
+	Description string   `json:"description"`
+	Actors      []string `json:"actors,omitempty"`
+	ActorField  string   `json:"actor_field,omitempty"`
+}
+
+type Rules []Rule
+
+// Config holds the rules for each store.
+type Config map[string]Rules
+
+func LoadConfig(path string) (Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %w", err)
+	}
+	var out Config
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("failed to decode rules: %w", err)
+	}
+	return out, nil
+}
+
+// Violation is returned when a change modifies a path that its actor is not allowed to.
+type Violation struct {
+	Change automerge.ChangeHash
+	Actor  string
+	Path   string
+	Rule   Rule
+}
+
+func (v *Violation) Error() string {
+	desc := v.Rule.Description
+	if v.Rule.Path == "" {
+		desc = "no rule allows changes to it"
+	} else if desc == "" {
+		desc = "rule " + v.Rule.Path
+	}
+	return fmt.Sprintf("change %s by actor %s may not modify %s: %s", v.Change.String()[:8], v.Actor, v.Path, desc)
+}
+
+// match returns true if the pattern matches the path or one of its parents.
+func match(pattern []string, path []interface{}) bool {
+	if len(path) < len(pattern) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != fmt.Sprint(path[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Rule) allows(before *automerge.Doc, actor string, pattern []string, path []interface{}) bool {
+	if slices.Contains(r.Actors, actor) || slices.Contains(r.Actors, "*") {
+		return true
+	}
+	if r.ActorField == "" {
+		return false
+	}
+	// the field is a sibling of the last segment of the pattern, eg: tasks/x/assignee for tasks/*/done
+	fieldPath := make([]interface{}, 0, len(pattern))
+	fieldPath = append(fieldPath, path[:len(pattern)-1]...)
+	v, err := before.Path(append(fieldPath, r.ActorField)...).Get()
+	if err != nil || v.Kind() != automerge.KindStr {
+		return false
+	}
+	return v.Str() == actor
+}
+
+// Check validates each of the changes, which must already be applied to the doc, and returns the first Violation.
+// Consecutive changes by one actor are checked together, against the doc before the first of them, so that a run of
+// local edits costs a single diff.
+func (r Rules) Check(doc *automerge.Doc, changes []*automerge.Change) error {
+	if len(r) == 0 {
+		return nil
+	}
+	patterns := make([][]string, len(r))
+	for i, rule := range r {
+		patterns[i] = strings.Split(rule.Path, "/")
+	}
+	for _, run := range runs(changes) {
+		first, last := run[0], run[len(run)-1]
+		// Fork with no heads returns the current state, so the very first change must be compared to an empty doc
+		before := automerge.New()
+		if deps := first.Dependencies(); len(deps) > 0 {
+			var err error
+			if before, err = doc.Fork(deps...); err != nil {
+				return fmt.Errorf("failed to checkout dependencies of %s: %w", first.Hash(), err)
+			}
+		}
+		after, err := doc.Fork(last.Hash())
+		if err != nil {
+			return fmt.Errorf("failed to checkout %s: %w", last.Hash(), err)
+		}
+		patches, err := docdiff.Diff(before, after)
+		if err != nil {
+			return err
+		}
+		for _, patch := range patches {
+			i := r.decider(patterns, patch.Path)
+			if i < 0 {
+				return &Violation{Change: first.Hash(), Actor: first.ActorID(), Path: docdiff.PathString(patch.Path)}
+			} else if patch.Before == nil {
+				continue
+			}
+			if !r[i].allows(before, first.ActorID(), patterns[i], patch.Path) {
+				return &Violation{Change: first.Hash(), Actor: first.ActorID(), Path: docdiff.PathString(patch.Path), Rule: r[i]}
+			}
+		}
+	}
+	return nil
+}
+
+// decider returns the index of the most specific rule that matches the path, or -1 if none do.
+func (r Rules) decider(patterns [][]string, path []interface{}) int {
+	found := -1
+	for i, pattern := range patterns {
+		if match(pattern, path) && (found < 0 || len(pattern) > len(patterns[found])) {
+			found = i
+		}
+	}
+	return found
+}
+
+// runs splits the changes, which are in causal order, into runs of changes by one actor that each follow directly on
+// the one before.
+func runs(changes []*automerge.Change) [][]*automerge.Change {
+	out := make([][]*automerge.Change, 0)
+	for _, change := range changes {
+		if n := len(out); n > 0 {
+			prev := out[n-1][len(out[n-1])-1]
+			if deps := change.Dependencies(); change.ActorID() == prev.ActorID() && len(deps) == 1 && deps[0] == prev.Hash() {
+				out[n-1] = append(out[n-1], change)
+				continue
+			}
+		}
+		out = append(out, []*automerge.Change{change})
+	}
+	return out
+}
@@ -0,0 +1,326 @@
+// Package richtext adds cursors and formatting marks to automerge Text.
+//
+// The version of automerge-go used here does not expose automerge's own cursors or marks, so they are approximated. A
+// Cursor is a position together with the heads of the doc when it was made. Resolving it compares the text at those
+// heads with the current text and follows the position through the differences, so it moves with the insertions and
+// deletions that any peer makes afterwards. Marks are stored in a map next to the text, each covering the range between
+// two cursors.
+//
+// The approximation compares characters rather than their identities, so it can differ from native cursors when text
+// is deleted and the same characters are inserted again nearby.
+package richtext
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+	"github.com/astromechza/automerge-experiments/pkg/codec"
+)
+
+const (
+	MarkBold   = "bold"
+	MarkItalic = "italic"
+	MarkCode   = "code"
+	MarkLink   = "link"
+)
+
+// maxDiffCells bounds the table used to align two versions of the text. Larger edits are treated as replacing the
+// whole changed region.
+const maxDiffCells = 1 << 22
+
+// Cursor is a position in a text that stays next to the same character as the text is edited.
+type Cursor struct {
+	Heads []string `automerge:"heads" json:"heads"`
+	Pos   int      `automerge:"pos" json:"pos"`
+}
+
+// Mark formats the text between two cursors.
+type Mark struct {
+	Type  string `automerge:"type"`
+	Start Cursor `automerge:"start"`
+	End   Cursor `automerge:"end"`
+	// Value is the target of a link
+	Value string `automerge:"value,omitempty"`
+}
+
+// Span is a mark resolved against the current text, covering the runes from Start up to End.
+type Span struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Value string `json:"value,omitempty"`
+}
+
+// NewCursor returns a cursor at the position in the text as it is now. Reading the heads commits any pending operations
+// as a change without a message, so commit them first, and don't make cursors inside a batch, see package batch.
+func NewCursor(doc *automerge.Doc, pos int) Cursor {
+	return Cursor{Heads: changehash.Encode(doc.Heads()), Pos: pos}
+}
+
+// textAt reads the text at the path, a missing text is empty.
+func textAt(doc *automerge.Doc, path []any) ([]rune, error) {
+	v, err := doc.Path(path...).Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get text: %w", err)
+	}
+	switch v.Kind() {
+	case automerge.KindVoid:
+		return nil, nil
+	case automerge.KindText:
+		s, err := v.Text().Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read text: %w", err)
+		}
+		return []rune(s), nil
+	}
+	return nil, fmt.Errorf("expected text but found %s", v.Kind())
+}
+
+// Resolver resolves cursors in one text. Cursors made at the same heads, such as the two ends of a mark, share the
+// work of reading the old text.
+type Resolver struct {
+	doc     *automerge.Doc
+	path    []any
+	heads   string
+	current []rune
+	past    map[string][]rune
+}
+
+func NewResolver(doc *automerge.Doc, path ...any) (*Resolver, error) {
+	current, err := textAt(doc, path)
+	if err != nil {
+		return nil, err
+	}
+	return &Resolver{
+		doc:     doc,
+		path:    path,
+		heads:   strings.Join(changehash.Encode(doc.Heads()), ","),
+		current: current,
+		past:    make(map[string][]rune),
+	}, nil
+}
+
+// Len returns the length of the current text in runes.
+func (r *Resolver) Len() int {
+	return len(r.current)
+}
+
+// Resolve returns the position of the cursor in the current text.
+func (r *Resolver) Resolve(c Cursor) (int, error) {
+	key := strings.Join(c.Heads, ",")
+	if key == r.heads {
+		return max(0, min(c.Pos, len(r.current))), nil
+	}
+	old, ok := r.past[key]
+	if !ok {
+		hashes, err := changehash.Decode(c.Heads)
+		if err != nil {
+			return 0, fmt.Errorf("invalid cursor: %w", err)
+		}
+		fork, err := r.doc.Fork(hashes...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read text as of cursor: %w", err)
+		}
+		if old, err = textAt(fork, r.path); err != nil {
+			return 0, err
+		}
+		r.past[key] = old
+	}
+	return mapPosition(old, r.current, c.Pos), nil
+}
+
+// mapPosition follows the position from one version of the text to the next. The position stays before the character
+// that followed it, or if that was deleted, before the next character that survived.
+func mapPosition(a, b []rune, pos int) int {
+	pos = max(0, min(pos, len(a)))
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	if pos < prefix {
+		return pos
+	} else if pos >= len(a)-suffix {
+		return pos + len(b) - len(a)
+	}
+	am, bm := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	rel := pos - prefix
+	if (len(am)+1)*(len(bm)+1) > maxDiffCells {
+		return prefix + len(bm)
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of am[i:] and bm[j:]
+	width := len(bm) + 1
+	lcs := make([]int32, (len(am)+1)*width)
+	for i := len(am) - 1; i >= 0; i-- {
+		for j := len(bm) - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			} else {
+				lcs[i*width+j] = max(lcs[(i+1)*width+j], lcs[i*width+j+1])
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(am) && j < len(bm) {
+		switch {
+		case am[i] == bm[j]:
+			if i >= rel {
+				return prefix + j
+			}
+			i, j = i+1, j+1
+		case lcs[(i+1)*width+j] >= lcs[i*width+j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+	return prefix + len(bm)
+}
+
+func newMarkID() string {
+	raw := make([]byte, 6)
+	_, _ = rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// AddMark formats the runes from start up to end of the current text, storing the mark in the map at marksPath, and
+// returns its id. The map must already exist. Links need a value. Like codec, it leaves committing the mark to the
+// caller, but the doc must have nothing else pending since its cursors read the heads, see NewCursor.
+func AddMark(doc *automerge.Doc, marksPath []any, markType string, start, end int, value string) (string, error) {
+	switch markType {
+	case MarkBold, MarkItalic, MarkCode:
+	case MarkLink:
+		if value == "" {
+			return "", fmt.Errorf("a link needs a target")
+		}
+	default:
+		return "", fmt.Errorf("unknown mark type %q", markType)
+	}
+	if start < 0 || end <= start {
+		return "", fmt.Errorf("invalid mark range %d to %d", start, end)
+	}
+	// a map created here by peers marking concurrently would keep the marks of only one of them
+	if v, err := doc.Path(marksPath...).Get(); err != nil {
+		return "", fmt.Errorf("failed to get marks: %w", err)
+	} else if v.Kind() != automerge.KindMap {
+		return "", fmt.Errorf("marks are a %s rather than a map", v.Kind())
+	}
+	id := newMarkID()
+	m := Mark{Type: markType, Start: NewCursor(doc, start), End: NewCursor(doc, end), Value: value}
+	if err := codec.Encode(doc.Path(append(slices.Clone(marksPath), id)...), m); err != nil {
+		return "", fmt.Errorf("failed to write mark: %w", err)
+	}
+	return id, nil
+}
+
+// RemoveMark deletes the mark from the map at marksPath.
+func RemoveMark(doc *automerge.Doc, marksPath []any, id string) error {
+	p := doc.Path(append(slices.Clone(marksPath), id)...)
+	if v, err := p.Get(); err != nil {
+		return fmt.Errorf("failed to get mark: %w", err)
+	} else if v.IsVoid() {
+		return fmt.Errorf("mark %s not found", id)
+	}
+	if err := p.Delete(); err != nil {
+		return fmt.Errorf("failed to delete mark: %w", err)
+	}
+	return nil
+}
+
+// Spans resolves the marks stored at marksPath against the text at textPath. Marks whose text has been deleted are
+// left out. The spans are sorted by where they start.
+func Spans(doc *automerge.Doc, textPath, marksPath []any) ([]Span, error) {
+	marks, err := codec.Decode[map[string]Mark](doc.Path(marksPath...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read marks: %w", err)
+	}
+	out := make([]Span, 0, len(marks))
+	if len(marks) == 0 {
+		return out, nil
+	}
+	r, err := NewResolver(doc, textPath...)
+	if err != nil {
+		return nil, err
+	}
+	for id, m := range marks {
+		start, err := r.Resolve(m.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := r.Resolve(m.End)
+		if err != nil {
+			return nil, err
+		}
+		if end > start {
+			out = append(out, Span{ID: id, Type: m.Type, Start: start, End: end, Value: m.Value})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Start != out[j].Start {
+			return out[i].Start < out[j].Start
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+// Markdown renders the text with its spans as markdown. Overlapping marks are split where they cross so that the
+// output nests correctly.
+func Markdown(text string, spans []Span) string {
+	runes := []rune(text)
+	bounds := []int{0, len(runes)}
+	for _, s := range spans {
+		bounds = append(bounds, max(0, min(s.Start, len(runes))), max(0, min(s.End, len(runes))))
+	}
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+
+	var b strings.Builder
+	for i := 0; i+1 < len(bounds); i++ {
+		from, to := bounds[i], bounds[i+1]
+		segment := string(runes[from:to])
+		var bold, italic, code bool
+		link := ""
+		for _, s := range spans {
+			if s.Start > from || s.End < to {
+				continue
+			}
+			switch s.Type {
+			case MarkBold:
+				bold = true
+			case MarkItalic:
+				italic = true
+			case MarkCode:
+				code = true
+			case MarkLink:
+				link = s.Value
+			}
+		}
+		if code {
+			segment = "`" + segment + "`"
+		}
+		if italic {
+			segment = "_" + segment + "_"
+		}
+		if bold {
+			segment = "**" + segment + "**"
+		}
+		if link != "" {
+			segment = "[" + segment + "](" + link + ")"
+		}
+		b.WriteString(segment)
+	}
+	return b.String()
+}
@@ -0,0 +1,330 @@
+// Package schema validates automerge documents against a subset of JSON Schema. Schemas can be loaded from JSON files
+// or defined in Go as Schema values.
+//
+// Documents are checked in their materialized form, see docdiff.Materialize: text is a string and counters are
+// integers. Automerge timestamps and byte strings have no JSON equivalent so they use the extra types "timestamp" and
+// "bytes".
+//
+// The supported keywords are type, enum, properties, required, additionalProperties, items, minItems, maxItems,
+// minLength, maxLength, pattern, minimum and maximum.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/docdiff"
+)
+
+// maxViolations limits how many violations are reported for a single document.
+const maxViolations = 10
+
+// Types is the type keyword, which may be a single type or a list of types in JSON.
+type Types []string
+
+func (t *Types) UnmarshalJSON(raw []byte) error {
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		*t = Types{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return fmt.Errorf("type must be a string or list of strings: %w", err)
+	}
+	*t = list
+	return nil
+}
+
+type Schema struct {
+	Description          string             `json:"description,omitempty"`
+	Type                 Types              `json:"type,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+
+	// Never is set by a false schema, which nothing matches.
+	Never bool `json:"-"`
+
+	pattern *regexp.Regexp
+}
+
+// UnmarshalJSON accepts the boolean schemas true and false as well as objects.
+func (s *Schema) UnmarshalJSON(raw []byte) error {
+	switch string(bytes.TrimSpace(raw)) {
+	case "true":
+		*s = Schema{}
+		return nil
+	case "false":
+		*s = Schema{Never: true}
+		return nil
+	}
+	type plain Schema
+	return json.Unmarshal(raw, (*plain)(s))
+}
+
+// Compile checks the schema and prepares its patterns. It must be called before Validate, LoadConfig does so for the
+// schemas it loads.
+func (s *Schema) Compile() error {
+	if s == nil {
+		return nil
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	for _, t := range s.Type {
+		if !slices.Contains([]string{"object", "array", "string", "number", "integer", "boolean", "null", "timestamp", "bytes"}, t) {
+			return fmt.Errorf("unsupported type %q", t)
+		}
+	}
+	for name, p := range s.Properties {
+		if err := p.Compile(); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if err := s.AdditionalProperties.Compile(); err != nil {
+		return fmt.Errorf("additionalProperties: %w", err)
+	}
+	if err := s.Items.Compile(); err != nil {
+		return fmt.Errorf("items: %w", err)
+	}
+	return nil
+}
+
+// Config holds the schema of each store.
+type Config map[string]*Schema
+
+func LoadConfig(path string) (Config, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schemas: %w", err)
+	}
+	var out Config
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, fmt.Errorf("failed to decode schemas: %w", err)
+	}
+	for store, s := range out {
+		if err := s.Compile(); err != nil {
+			return nil, fmt.Errorf("invalid schema for store %s: %w", store, err)
+		}
+	}
+	return out, nil
+}
+
+// Violation is a single place where the document does not match the schema.
+type Violation struct {
+	Path    string
+	Message string
+}
+
+func (v Violation) String() string {
+	if v.Path == "" {
+		return v.Message
+	}
+	return v.Path + ": " + v.Message
+}
+
+// Error is returned when a document does not match the schema.
+type Error struct {
+	Violations []Violation
+}
+
+func (e *Error) Error() string {
+	parts := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		parts[i] = v.String()
+	}
+	return "document does not match schema: " + strings.Join(parts, "; ")
+}
+
+// ValidateDoc checks the whole document and returns an *Error if it does not match.
+func (s *Schema) ValidateDoc(doc *automerge.Doc) error {
+	v, err := docdiff.MaterializeDoc(doc)
+	if err != nil {
+		return fmt.Errorf("failed to read doc: %w", err)
+	}
+	return s.Validate(v)
+}
+
+// Validate checks a materialized value and returns an *Error if it does not match.
+func (s *Schema) Validate(v interface{}) error {
+	var out []Violation
+	s.validate(nil, v, &out)
+	if len(out) == 0 {
+		return nil
+	}
+	return &Error{Violations: out}
+}
+
+func (s *Schema) validate(path []interface{}, v interface{}, out *[]Violation) {
+	if s == nil || len(*out) >= maxViolations {
+		return
+	}
+	report := func(format string, args ...interface{}) {
+		if len(*out) < maxViolations {
+			*out = append(*out, Violation{Path: docdiff.PathString(path), Message: fmt.Sprintf(format, args...)})
+		}
+	}
+	if s.Never {
+		report("no value is allowed here")
+		return
+	}
+	if len(s.Type) > 0 && !slices.ContainsFunc(s.Type, func(t string) bool { return isType(t, v) }) {
+		report("expected %s but got %s", strings.Join(s.Type, " or "), typeOf(v))
+		return
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e interface{}) bool { return equal(e, v) }) {
+		report("%v is not one of the allowed values", v)
+	}
+
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := tv[name]; !ok {
+				report("missing required property %q", name)
+			}
+		}
+		keys := make([]string, 0, len(tv))
+		for k := range tv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := append(slices.Clip(path), k)
+			if p, ok := s.Properties[k]; ok {
+				p.validate(child, tv[k], out)
+			} else {
+				s.AdditionalProperties.validate(child, tv[k], out)
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(tv) < *s.MinItems {
+			report("expected at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(tv) > *s.MaxItems {
+			report("expected at most %d items", *s.MaxItems)
+		}
+		for i, item := range tv {
+			s.Items.validate(append(slices.Clip(path), i), item, out)
+		}
+	case string:
+		n := utf8.RuneCountInString(tv)
+		if s.MinLength != nil && n < *s.MinLength {
+			report("expected at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			report("expected at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(tv) {
+			report("%q does not match %s", tv, s.Pattern)
+		}
+	default:
+		if f, ok := number(v); ok {
+			if s.Minimum != nil && f < *s.Minimum {
+				report("%v is less than %v", v, *s.Minimum)
+			}
+			if s.Maximum != nil && f > *s.Maximum {
+				report("%v is greater than %v", v, *s.Maximum)
+			}
+		}
+	}
+}
+
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func isType(t string, v interface{}) bool {
+	switch t {
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := number(v)
+		return ok
+	case "integer":
+		f, ok := number(v)
+		return ok && f == math.Trunc(f)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	case "timestamp":
+		_, ok := v.(time.Time)
+		return ok
+	case "bytes":
+		_, ok := v.([]byte)
+		return ok
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	for _, t := range []string{"object", "array", "string", "integer", "number", "boolean", "null", "timestamp", "bytes"} {
+		if isType(t, v) {
+			return t
+		}
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// equal compares an enum value, which comes from JSON or Go, with a materialized value.
+func equal(e, v interface{}) bool {
+	if ef, ok := number(e); ok {
+		vf, ok := number(v)
+		return ok && ef == vf
+	}
+	if ei, ok := e.(int); ok {
+		vf, ok := number(v)
+		return ok && float64(ei) == vf
+	}
+	return reflect.DeepEqual(e, v)
+}
+
+// MustCompile compiles the schema and panics if it is invalid. It is intended for schemas defined in Go.
+func MustCompile(s *Schema) *Schema {
+	if err := s.Compile(); err != nil {
+		panic(fmt.Sprintf("schema: %v", err))
+	}
+	return s
+}
@@ -0,0 +1,165 @@
+// Package syncprogress reports how far along a sync is, in the same shape for every sync transport.
+//
+// Automerge's sync protocol does not say how much is left, only which heads each side has. The remote can count the
+// changes we are missing from the heads in our last sync message to it, see MissingCounter, and the changes that have
+// arrived since are taken off that. It is only an estimate: while the remote has yet to receive changes of ours it
+// doesn't know our heads, and counts from the ones it does know, which makes it too high until our changes reach it.
+// It also ignores changes the remote receives from others during the sync.
+package syncprogress
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+)
+
+// Progress is the running total of a sync.
+type Progress struct {
+	MessagesSent     int `json:"messages_sent"`
+	MessagesReceived int `json:"messages_received"`
+	BytesSent        int `json:"bytes_sent"`
+	BytesReceived    int `json:"bytes_received"`
+	// ChangesApplied is how many changes from the remote have been applied to our doc.
+	ChangesApplied int `json:"changes_applied"`
+
+	LocalHeads  []string `json:"local_heads"`
+	RemoteHeads []string `json:"remote_heads"`
+	// Outstanding is the estimated number of changes still to receive, zero until the remote says how many we miss.
+	Outstanding int `json:"outstanding"`
+
+	// InSync is set once both sides have the same heads. It is reported once more when the sync is finished.
+	InSync bool `json:"in_sync"`
+}
+
+// Fraction estimates how much of the changes to receive have been received, between 0 and 1.
+func (p Progress) Fraction() float64 {
+	if p.InSync {
+		return 1
+	} else if total := p.ChangesApplied + p.Outstanding; total > 0 {
+		return float64(p.ChangesApplied) / float64(total)
+	}
+	return 0
+}
+
+// Tracker accumulates the progress of one sync and reports it after every event. Sent and Received read the doc, so
+// they must be called while holding whatever lock guards it.
+type Tracker struct {
+	lock   sync.Mutex
+	doc    *automerge.Doc
+	p      Progress
+	report func(Progress)
+
+	// missing is what the remote last said we miss, and appliedThen is ChangesApplied at the time
+	missing, appliedThen int
+	heard                bool
+}
+
+// NewTracker starts tracking a sync of the doc. Report is called with the progress after each event, from whichever
+// goroutine recorded it, and may be nil.
+func NewTracker(doc *automerge.Doc, report func(Progress)) *Tracker {
+	t := &Tracker{doc: doc, report: report}
+	t.p.LocalHeads = changehash.Encode(doc.Heads())
+	return t
+}
+
+// Progress returns the progress so far.
+func (t *Tracker) Progress() Progress {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.p
+}
+
+// update changes the progress, recomputes the estimates and reports it.
+func (t *Tracker) update(fn func(p *Progress)) {
+	t.lock.Lock()
+	fn(&t.p)
+	if t.heard {
+		t.p.Outstanding = max(0, t.missing-(t.p.ChangesApplied-t.appliedThen))
+	}
+	t.p.InSync = t.p.RemoteHeads != nil && slices.Equal(t.p.LocalHeads, t.p.RemoteHeads)
+	if t.p.InSync {
+		t.p.Outstanding = 0
+	}
+	p := t.p
+	t.lock.Unlock()
+	if t.report != nil {
+		t.report(p)
+	}
+}
+
+// Sent records messages sent to the remote.
+func (t *Tracker) Sent(messages, bytes int) {
+	heads := changehash.Encode(t.doc.Heads())
+	t.update(func(p *Progress) {
+		p.MessagesSent += messages
+		p.BytesSent += bytes
+		p.LocalHeads = heads
+	})
+}
+
+// Received records messages received from the remote and the changes they brought, with the remote heads they
+// announced if there were any.
+func (t *Tracker) Received(messages, bytes, changes int, remoteHeads []automerge.ChangeHash) {
+	heads := changehash.Encode(t.doc.Heads())
+	t.update(func(p *Progress) {
+		p.MessagesReceived += messages
+		p.BytesReceived += bytes
+		p.ChangesApplied += changes
+		p.LocalHeads = heads
+		if remoteHeads != nil {
+			p.RemoteHeads = changehash.Encode(remoteHeads)
+		}
+	})
+}
+
+// RemoteStatus records the heads the remote said it has, if any, and how many of its changes it said we miss. It must
+// be recorded before the changes that the remote sent after saying so.
+func (t *Tracker) RemoteStatus(heads []string, missing int) {
+	t.update(func(p *Progress) {
+		if heads != nil {
+			p.RemoteHeads = slices.Clone(heads)
+			slices.Sort(p.RemoteHeads)
+		}
+		t.missing, t.appliedThen, t.heard = missing, p.ChangesApplied, true
+	})
+}
+
+// Done reports the final progress once the sync has finished.
+func (t *Tracker) Done() {
+	t.update(func(p *Progress) {})
+}
+
+// MissingCounter counts the changes of a doc that a peer lacks, from the heads that the peer last announced. Heads the
+// doc doesn't have are left out, so the count is too high while the peer has changes the doc has yet to receive. The
+// count is kept until the heads of either side change, so that it is cheap to ask for on every round.
+type MissingCounter struct {
+	lock      sync.Mutex
+	heads     []automerge.ChangeHash
+	peerHeads []automerge.ChangeHash
+	missing   int
+}
+
+func (m *MissingCounter) Count(doc *automerge.Doc, peerHeads []automerge.ChangeHash) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	heads := doc.Heads()
+	if m.heads != nil && slices.Equal(heads, m.heads) && slices.Equal(peerHeads, m.peerHeads) {
+		return m.missing, nil
+	}
+	known := make([]automerge.ChangeHash, 0, len(peerHeads))
+	for _, h := range peerHeads {
+		if _, err := doc.Change(h); err == nil {
+			known = append(known, h)
+		}
+	}
+	changes, err := doc.Changes(known...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list missing changes: %w", err)
+	}
+	m.heads, m.peerHeads, m.missing = heads, slices.Clone(peerHeads), len(changes)
+	return m.missing, nil
+}
@@ -0,0 +1,124 @@
+package todo
+
+import (
+	"fmt"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/codec"
+	"github.com/astromechza/automerge-experiments/pkg/richtext"
+)
+
+const (
+	descriptionKey = "description"
+	marksKey       = "description_marks"
+)
+
+// descriptionText returns the description of the task. Add creates it with the task, rather than the first edit, since
+// peers making their first edits concurrently would each create a text and all but one of them would be lost.
+func descriptionText(doc *automerge.Doc, id string) (*automerge.Text, error) {
+	m, err := taskMap(doc, id)
+	if err != nil {
+		return nil, err
+	}
+	v, err := m.Get(descriptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get description: %w", err)
+	} else if v.Kind() != automerge.KindText {
+		return nil, fmt.Errorf("description of task %s is a %s", id, v.Kind())
+	}
+	return v.Text(), nil
+}
+
+// SetDescription changes the description with the smallest splice that produces the new one, so that concurrent edits
+// to other parts of it are kept.
+func SetDescription(doc *automerge.Doc, id, description string) (string, error) {
+	text, err := descriptionText(doc, id)
+	if err != nil {
+		return "", err
+	}
+	if changed, err := codec.UpdateText(text, description); err != nil {
+		return "", fmt.Errorf("failed to update description: %w", err)
+	} else if !changed {
+		return "", nil
+	}
+	return edited(doc, id, "edit description of task %s", id)
+}
+
+// SpliceDescription deletes del runes at pos of the description and inserts s in their place, for editors that know
+// where the edit happened rather than only the result.
+func SpliceDescription(doc *automerge.Doc, id string, pos, del int, s string) (string, error) {
+	text, err := descriptionText(doc, id)
+	if err != nil {
+		return "", err
+	}
+	if pos < 0 || del < 0 || pos+del > text.Len() {
+		return "", fmt.Errorf("splice of %d at %d is outside the description of length %d", del, pos, text.Len())
+	}
+	if err := text.Splice(pos, del, s); err != nil {
+		return "", fmt.Errorf("failed to splice description: %w", err)
+	}
+	return edited(doc, id, "edit description of task %s", id)
+}
+
+// DescriptionCursor returns a cursor at the position in the description, which follows later edits. See package
+// richtext for how it works. Like MarkDescription it must not run inside a batch.
+func DescriptionCursor(doc *automerge.Doc, id string, pos int) (richtext.Cursor, error) {
+	if _, err := taskMap(doc, id); err != nil {
+		return richtext.Cursor{}, err
+	}
+	return richtext.NewCursor(doc, pos), nil
+}
+
+// ResolveDescriptionCursor returns the current position of the cursor in the description.
+func ResolveDescriptionCursor(doc *automerge.Doc, id string, c richtext.Cursor) (int, error) {
+	if _, err := taskMap(doc, id); err != nil {
+		return 0, err
+	}
+	r, err := richtext.NewResolver(doc, tasksKey, id, descriptionKey)
+	if err != nil {
+		return 0, err
+	}
+	return r.Resolve(c)
+}
+
+// MarkDescription formats the runes from start up to end of the description with one of the richtext mark types, and
+// returns the id of the mark and the message of the operation. Links take their target as the value.
+//
+// The mark's cursors read the heads, which commits whatever is pending, see richtext.NewCursor. Run it on the doc
+// after flushing any batch and commit it straight away, rather than through batch.Batcher.Edit, where it would split
+// the batch into an extra change with no message or clock.
+func MarkDescription(doc *automerge.Doc, id, markType string, start, end int, value string) (string, string, error) {
+	text, err := descriptionText(doc, id)
+	if err != nil {
+		return "", "", err
+	} else if end > text.Len() {
+		return "", "", fmt.Errorf("mark ends at %d, past the end of the description", end)
+	}
+	markID, err := richtext.AddMark(doc, []any{tasksKey, id, marksKey}, markType, start, end, value)
+	if err != nil {
+		return "", "", err
+	}
+	msg, err := edited(doc, id, "mark description of task %s as %s", id, markType)
+	return markID, msg, err
+}
+
+// UnmarkDescription removes a mark from the description.
+func UnmarkDescription(doc *automerge.Doc, id, markID string) (string, error) {
+	if _, err := taskMap(doc, id); err != nil {
+		return "", err
+	}
+	if err := richtext.RemoveMark(doc, []any{tasksKey, id, marksKey}, markID); err != nil {
+		return "", err
+	}
+	return edited(doc, id, "remove mark %s from description of task %s", markID, id)
+}
+
+// DescriptionSpans returns the marks of the description resolved against its current text. Render them with
+// richtext.Markdown.
+func DescriptionSpans(doc *automerge.Doc, id string) ([]richtext.Span, error) {
+	if _, err := taskMap(doc, id); err != nil {
+		return nil, err
+	}
+	return richtext.Spans(doc, []any{tasksKey, id, descriptionKey}, []any{tasksKey, id, marksKey})
+}
@@ -0,0 +1,44 @@
+package todo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/epoch"
+)
+
+// NewEpoch starts the next epoch of the doc, see package epoch, or returns nil if the doc does not hold a todo list.
+// The doc is migrated to the latest schema version first. The new epoch is started on the genesis and migrations of
+// New, which every peer makes for itself, so that a new replica merges with it.
+func NewEpoch(doc *automerge.Doc) (*automerge.Doc, error) {
+	if v, err := doc.Path(tasksKey).Get(); err != nil || v.Kind() != automerge.KindMap {
+		return nil, nil
+	}
+	if _, err := Migrations.Migrate(doc); err != nil {
+		return nil, err
+	}
+	base, err := New()
+	if err != nil {
+		return nil, err
+	}
+	return epoch.Start(doc, base)
+}
+
+// Forward carries the local edits that the archive of their epoch lacks over to the next epoch in one commit, and
+// returns the paths it changed. Next should already have the local actor.
+func Forward(next, archive, local *automerge.Doc) ([]string, error) {
+	paths, err := epoch.Forward(next, archive, local)
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+	info, err := epoch.Of(archive)
+	if err != nil {
+		return nil, err
+	}
+	if err := Commit(next, fmt.Sprintf("carry changes to %s forward from epoch %d", strings.Join(paths, ", "), info.Number)); err != nil {
+		return nil, fmt.Errorf("failed to commit forwarded changes: %w", err)
+	}
+	return paths, nil
+}
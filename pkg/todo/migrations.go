@@ -0,0 +1,78 @@
+package todo
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/migrate"
+)
+
+const versionKey = "schema_version"
+
+// Migrations upgrade todo docs to the current schema. Init applies them, so every operation sees the latest schema.
+var Migrations = &migrate.Registry{
+	VersionKey: versionKey,
+	Migrations: []migrate.Migration{
+		{
+			To:          1,
+			Description: "record the schema version",
+			Apply:       func(doc *automerge.Doc) error { return nil },
+		},
+		{
+			To:          2,
+			Description: "give every task a description and a map for its marks",
+			Apply:       addDescriptions,
+		},
+	},
+}
+
+// addDescriptions creates the description text and marks map of the tasks that were added before Add created them, so
+// that the first edits to them don't each create their own.
+func addDescriptions(doc *automerge.Doc) error {
+	v, err := doc.Path(tasksKey).Get()
+	if err != nil {
+		return fmt.Errorf("failed to get tasks: %w", err)
+	} else if v.Kind() != automerge.KindMap {
+		return nil
+	}
+	ids, err := v.Map().Keys()
+	if err != nil {
+		return fmt.Errorf("failed to list tasks: %w", err)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, key := range []string{descriptionKey, marksKey} {
+			current, err := doc.Path(tasksKey, id, key).Get()
+			if err != nil {
+				return fmt.Errorf("failed to get %s of %s: %w", key, id, err)
+			} else if !current.IsVoid() {
+				continue
+			}
+			var value interface{} = automerge.NewMap()
+			if key == descriptionKey {
+				value = automerge.NewText("")
+			}
+			if err := doc.Path(tasksKey, id, key).Set(value); err != nil {
+				return fmt.Errorf("failed to create %s of %s: %w", key, id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Upgrade migrates the doc if it holds a todo list, and returns the number of migrations applied. Unlike Init it leaves
+// other docs alone, so it can be run on every doc a server loads.
+func Upgrade(doc *automerge.Doc) (int, error) {
+	if !IsList(doc) {
+		return 0, nil
+	}
+	return Migrations.Migrate(doc)
+}
+
+// IsList returns true if the doc holds a todo list.
+func IsList(doc *automerge.Doc) bool {
+	v, err := doc.Path(tasksKey).Get()
+	return err == nil && v.Kind() == automerge.KindMap
+}
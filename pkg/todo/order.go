@@ -0,0 +1,59 @@
+package todo
+
+import (
+	"strings"
+)
+
+// orderDigits are the digits of the fractional order keys, in ascending byte order so that keys compare as strings.
+const orderDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+func digitAt(s string, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return orderDigits[0]
+}
+
+func suffix(s string, i int) string {
+	if i < len(s) {
+		return s[i:]
+	}
+	return ""
+}
+
+// orderBetween returns a key that sorts strictly between a and b, where an empty a is the start and an empty b is the
+// end of the list. Keys never end in the zero digit, which guarantees there is always room between two of them. Moving
+// a task only rewrites its own key, so concurrent moves of different tasks never conflict, and concurrent moves of the
+// same task resolve to one of the positions.
+//
+// Two peers inserting at the same place concurrently produce the same key, so ties are broken by task id. If a is not
+// below b because of such a tie, the key is placed after a instead.
+func orderBetween(a, b string) string {
+	if b != "" && a >= b {
+		b = ""
+	}
+	if b != "" {
+		n := 0
+		for n < len(b) && digitAt(a, n) == b[n] {
+			n++
+		}
+		if n > 0 {
+			return b[:n] + orderBetween(suffix(a, n), b[n:])
+		}
+	}
+	da := 0
+	if a != "" {
+		da = strings.IndexByte(orderDigits, a[0])
+	}
+	db := len(orderDigits)
+	if b != "" {
+		db = strings.IndexByte(orderDigits, b[0])
+	}
+	if db-da > 1 {
+		return string(orderDigits[(da+db)/2])
+	}
+	if b != "" && len(b) > 1 {
+		return b[:1]
+	}
+	return string(orderDigits[da]) + orderBetween(suffix(a, 1), "")
+}
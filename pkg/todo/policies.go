@@ -0,0 +1,36 @@
+package todo
+
+import (
+	"slices"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/conflicts"
+	"github.com/astromechza/automerge-experiments/pkg/mergepolicy"
+)
+
+// Policies picks the winner of concurrent edits to the fields where automerge's own choice is wrong for a todo list.
+var Policies = &mergepolicy.Registry{
+	Rules: []mergepolicy.Rule{
+		{Path: tasksKey + "/*/due", Description: "the most recently set due date wins", Policy: mergepolicy.LastWriterWins},
+		{Path: tasksKey + "/*/status", Description: "a task stays open unless it was completed after being reopened", Policy: mergepolicy.Prefer(StatusOpen)},
+	},
+}
+
+// Conflicts returns the conflicts of the doc like conflicts.Find, leaving out updated_at. Every edit to a task stamps
+// it, so concurrent edits to different fields of a task always conflict there, and the later clock wins anyway.
+func Conflicts(doc *automerge.Doc, since ...automerge.ChangeHash) ([]conflicts.Conflict, error) {
+	found, err := conflicts.Find(doc, since...)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(found, func(c conflicts.Conflict) bool {
+		return len(c.Path) == 3 && c.Path[0] == tasksKey && c.Path[2] == updatedAtKey
+	}), nil
+}
+
+// ResolveConflicts applies Policies to the doc and returns the paths it changed. Call it after merging in changes from
+// other peers, with the heads it was last called with if only the conflicts that arrived since then need resolving.
+func ResolveConflicts(doc *automerge.Doc, since ...automerge.ChangeHash) ([]string, error) {
+	return Policies.Resolve(doc, since...)
+}
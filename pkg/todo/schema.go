@@ -0,0 +1,60 @@
+package todo
+
+import (
+	"github.com/astromechza/automerge-experiments/pkg/richtext"
+	"github.com/astromechza/automerge-experiments/pkg/schema"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+var cursorSchema = &schema.Schema{
+	Type:     schema.Types{"object"},
+	Required: []string{"heads", "pos"},
+	Properties: map[string]*schema.Schema{
+		"heads": {Type: schema.Types{"array"}, Items: &schema.Schema{Type: schema.Types{"string"}, Pattern: "^[0-9a-f]{64}$"}},
+		"pos":   {Type: schema.Types{"integer"}, Minimum: ptr(0.0)},
+	},
+}
+
+// Schema describes the todo document for validation, the cmd/four server checks todo stores against it unless it is
+// given another schema. Unknown keys are allowed so that other data, such as display names, can live in the same doc.
+var Schema = schema.MustCompile(&schema.Schema{
+	Type: schema.Types{"object"},
+	Properties: map[string]*schema.Schema{
+		versionKey: {Type: schema.Types{"integer"}, Minimum: ptr(1.0)},
+		tasksKey: {
+			Type: schema.Types{"object"},
+			AdditionalProperties: &schema.Schema{
+				Type:     schema.Types{"object"},
+				Required: []string{"title", "description", marksKey, "status", "order"},
+				Properties: map[string]*schema.Schema{
+					"title":       {Type: schema.Types{"string"}, MinLength: ptr(1)},
+					"description": {Type: schema.Types{"string"}},
+					marksKey: {
+						Type: schema.Types{"object"},
+						AdditionalProperties: &schema.Schema{
+							Type:     schema.Types{"object"},
+							Required: []string{"type", "start", "end"},
+							Properties: map[string]*schema.Schema{
+								"type":  {Enum: []interface{}{richtext.MarkBold, richtext.MarkItalic, richtext.MarkCode, richtext.MarkLink}},
+								"start": cursorSchema,
+								"end":   cursorSchema,
+								"value": {Type: schema.Types{"string"}},
+							},
+						},
+					},
+					"status":       {Enum: []interface{}{StatusOpen, StatusDone}},
+					"assignee":     {Type: schema.Types{"string"}},
+					"due":          {Type: schema.Types{"timestamp"}},
+					"tags":         {Type: schema.Types{"object"}, AdditionalProperties: &schema.Schema{Type: schema.Types{"boolean"}}},
+					"order":        {Type: schema.Types{"string"}, Pattern: "^[0-9A-Za-z]*[1-9A-Za-z]$"},
+					"created_at":   {Type: schema.Types{"timestamp"}},
+					"updated_at":   {Type: schema.Types{"string"}, Pattern: "^[0-9]{13}\\.[0-9]{6}$"},
+					"completed_at": {Type: schema.Types{"timestamp"}},
+				},
+			},
+		},
+	},
+})
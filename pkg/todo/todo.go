@@ -0,0 +1,577 @@
+// Package todo defines the TODO list document schema and the operations on it. The document looks like:
+//
+//	{
+//	  "schema_version": 2,
+//	  "tasks": {
+//	    "<id>": {
+//	      "title": Text,
+//	      "description": Text,
+//	      "description_marks": {"<id>": {"type": "bold", "start": Cursor, "end": Cursor}},
+//	      "status": "open" | "done",
+//	      "assignee": "alice",         // optional
+//	      "due": Time,                 // optional
+//	      "tags": {"<tag>": true},
+//	      "order": "V",
+//	      "created_at": Time,
+//	      "updated_at": "1760814290123.000000", // a hybrid logical clock timestamp, see package hlc
+//	      "completed_at": Time         // only while done
+//	    }
+//	  }
+//	}
+//
+// Every field is its own register so concurrent edits to different fields of a task both survive. Titles are text so
+// concurrent renames are merged character by character, tags are a map so that concurrent tagging behaves like a set,
+// and ordering uses fractional keys so a move only touches the moved task. Descriptions are text with formatting marks
+// kept beside them, see package richtext. Deleting a task removes it, and wins over
+// concurrent edits to it.
+//
+// Operations leave their changes pending and return a message describing them, or an empty one if they changed nothing,
+// for the caller to commit with Commit, or with CommitBatch for a batch of them. Commits carry a hybrid logical clock
+// timestamp from Clock, which also dates the task fields. Clients should call Observe after merging in changes from
+// other peers.
+package todo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/batch"
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+	"github.com/astromechza/automerge-experiments/pkg/codec"
+	"github.com/astromechza/automerge-experiments/pkg/hlc"
+	"github.com/astromechza/automerge-experiments/pkg/mergepolicy"
+)
+
+const (
+	StatusOpen = "open"
+	StatusDone = "done"
+
+	tasksKey     = "tasks"
+	updatedAtKey = "updated_at"
+	// genesisActor creates the tasks map. Using a fixed actor and time means every peer that initialises a doc creates
+	// exactly the same change, so the docs can merge without one tasks map replacing the other.
+	genesisActor = "746f646f2d67656e65736973"
+)
+
+var ErrNotFound = errors.New("task not found")
+
+// ErrTitleRequired is returned for an empty title, which the schema does not allow.
+var ErrTitleRequired = errors.New("title is required")
+
+type Task struct {
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	// Description is the plain text of the description, DescriptionSpans returns its formatting.
+	Description string     `json:"description,omitempty"`
+	Status      string     `json:"status"`
+	Assignee    string     `json:"assignee,omitempty"`
+	Due         *time.Time `json:"due,omitempty"`
+	Tags        []string   `json:"tags,omitempty"`
+	Order       string     `json:"order"`
+	CreatedAt   time.Time  `json:"created_at"`
+	// UpdatedAt is the hybrid logical clock time of the last operation on the task.
+	UpdatedAt   hlc.Timestamp `json:"updated_at"`
+	CompletedAt *time.Time    `json:"completed_at,omitempty"`
+}
+
+// Init adds the schema to the doc if it is not already there and migrates it to the latest version. It is safe to call
+// on every peer, and returns migrate.ErrNewerVersion if the doc was written by a newer version of this package.
+func Init(doc *automerge.Doc) error {
+	if v, err := doc.Path(tasksKey).Get(); err != nil || v.Kind() != automerge.KindMap {
+		if err := initGenesis(doc); err != nil {
+			return err
+		}
+	}
+	if _, err := Migrations.Migrate(doc); err != nil {
+		return err
+	}
+	return nil
+}
+
+// initGenesis merges the genesis change into the doc. The genesis must never change, since a doc created by a peer with
+// a different genesis would have its own tasks map, and schema changes belong in Migrations instead.
+func initGenesis(doc *automerge.Doc) error {
+	genesis := automerge.New()
+	if err := genesis.SetActorID(genesisActor); err != nil {
+		return fmt.Errorf("failed to set genesis actor: %w", err)
+	}
+	if err := genesis.Path(tasksKey).Set(automerge.NewMap()); err != nil {
+		return fmt.Errorf("failed to create tasks: %w", err)
+	}
+	epoch := time.UnixMilli(0)
+	if _, err := genesis.Commit("create todo list", automerge.CommitOptions{Time: &epoch}); err != nil {
+		return fmt.Errorf("failed to commit genesis: %w", err)
+	}
+	if _, err := doc.Merge(genesis); err != nil {
+		return fmt.Errorf("failed to merge genesis: %w", err)
+	}
+	return nil
+}
+
+// New returns a new doc with the schema.
+func New() (*automerge.Doc, error) {
+	doc := automerge.New()
+	if err := Init(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// IsDerived returns true if the change is the genesis, a migration or a conflict resolution of a todo list, which every
+// peer makes the same way with an actor that belongs to no device. It is an identity.Derived for signing, verifying
+// needs Reproduced.
+func IsDerived(change *automerge.Change) bool {
+	if change.ActorID() == genesisActor && len(change.Dependencies()) == 0 {
+		return true
+	}
+	return changehash.IsDerived(change, append(Migrations.ActorLabels(), mergepolicy.ActorLabel))
+}
+
+// Reproduced returns an identity.Derived that only accepts the derived changes that come out the same when made again
+// from their dependencies in the doc. Derived actors are public, so IsDerived alone would let any device write anything
+// as one. The doc must hold the dependencies of the changes it checks.
+func Reproduced(doc *automerge.Doc) func(change *automerge.Change) bool {
+	return func(change *automerge.Change) bool {
+		if !IsDerived(change) {
+			return false
+		}
+		deps := change.Dependencies()
+		var base *automerge.Doc
+		var err error
+		switch {
+		case len(deps) == 0:
+			base = automerge.New()
+			err = initGenesis(base)
+		case change.ActorID() == changehash.Actor(mergepolicy.ActorLabel, deps):
+			if base, err = doc.Fork(deps...); err == nil {
+				_, err = ResolveConflicts(base)
+			}
+		default:
+			// the first migration that Migrate makes starts from the dependencies, it is the only one that can match
+			if base, err = doc.Fork(deps...); err == nil {
+				_, err = Migrations.Migrate(base)
+			}
+		}
+		if err != nil {
+			return false
+		}
+		_, err = base.Change(change.Hash())
+		return err == nil
+	}
+}
+
+func newID() string {
+	raw := make([]byte, 6)
+	_, _ = rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+func taskMap(doc *automerge.Doc, id string) (*automerge.Map, error) {
+	v, err := doc.Path(tasksKey, id).Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get task: %w", err)
+	} else if v.Kind() != automerge.KindMap {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	return v.Map(), nil
+}
+
+// Clock stamps the commits and timestamp fields of the operations. It is advanced past the changes of other peers by
+// Observe.
+var Clock = hlc.New()
+
+// Observe advances Clock past the changes of the doc after the given heads, which should be the heads from before
+// changes from other peers were merged in. With no heads it observes the whole history.
+func Observe(doc *automerge.Doc, since ...automerge.ChangeHash) error {
+	changes, err := doc.Changes(since...)
+	if err != nil {
+		return fmt.Errorf("failed to list changes: %w", err)
+	}
+	return ObserveChanges(changes)
+}
+
+// ObserveChanges advances Clock past the changes, call it as they are received so that no local edit made after them
+// is stamped behind them.
+func ObserveChanges(changes []*automerge.Change) error {
+	if ignored := Clock.ObserveChanges(changes); ignored > 0 {
+		return fmt.Errorf("ignored %d changes with clocks more than %s ahead", ignored, Clock.MaxOffset)
+	}
+	return nil
+}
+
+// Commit commits the pending operations with the message, which is stamped with Clock.
+func Commit(doc *automerge.Doc, msg string) error {
+	return commitAt(doc, Clock.Now(), msg)
+}
+
+// CommitBatch commits a batch of operations, see package batch. Use it as the Commit of a batch.Batcher.
+func CommitBatch(fork *automerge.Doc, messages []string) error {
+	return Commit(fork, batch.Message(messages))
+}
+
+// commitAt commits with the timestamp in the message and as the commit time.
+func commitAt(doc *automerge.Doc, ts hlc.Timestamp, msg string) error {
+	t := ts.Time()
+	if _, err := doc.Commit(hlc.Stamp(msg, ts), automerge.CommitOptions{Time: &t}); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+func edited(doc *automerge.Doc, id, format string, args ...any) (string, error) {
+	return editedAt(doc, id, Clock.Now(), format, args...)
+}
+
+// editedAt records the timestamp as the time the task was last updated, and returns the message of the operation.
+func editedAt(doc *automerge.Doc, id string, ts hlc.Timestamp, format string, args ...any) (string, error) {
+	if m, err := taskMap(doc, id); err == nil {
+		if err := m.Set(updatedAtKey, ts.String()); err != nil {
+			return "", fmt.Errorf("failed to set updated at: %w", err)
+		}
+	}
+	return fmt.Sprintf(format, args...), nil
+}
+
+// NewTask holds the initial fields of a task, only the title is required.
+type NewTask struct {
+	Title       string
+	Description string
+	Assignee    string
+	Due         *time.Time
+	Tags        []string
+}
+
+// Add creates a task at the end of the list and returns its id and the message of the operation.
+func Add(doc *automerge.Doc, t NewTask) (string, string, error) {
+	if t.Title == "" {
+		return "", "", ErrTitleRequired
+	}
+	if err := Init(doc); err != nil {
+		return "", "", err
+	}
+	tasks, err := Query(doc, Filter{})
+	if err != nil {
+		return "", "", err
+	}
+	last := ""
+	if len(tasks) > 0 {
+		last = tasks[len(tasks)-1].Order
+	}
+	id := newID()
+	ts := Clock.Now()
+	m := automerge.NewMap()
+	if err := doc.Path(tasksKey, id).Set(m); err != nil {
+		return "", "", fmt.Errorf("failed to create task: %w", err)
+	}
+	tags := automerge.NewMap()
+	for _, err := range []error{
+		m.Set("title", automerge.NewText(t.Title)),
+		m.Set("status", StatusOpen),
+		m.Set("order", orderBetween(last, "")),
+		m.Set("created_at", ts.Time()),
+		m.Set("tags", tags),
+		m.Set(descriptionKey, automerge.NewText(t.Description)),
+		m.Set(marksKey, automerge.NewMap()),
+	} {
+		if err != nil {
+			return "", "", fmt.Errorf("failed to set task field: %w", err)
+		}
+	}
+	if t.Assignee != "" {
+		if err := m.Set("assignee", t.Assignee); err != nil {
+			return "", "", fmt.Errorf("failed to set assignee: %w", err)
+		}
+	}
+	if t.Due != nil {
+		if err := m.Set("due", *t.Due); err != nil {
+			return "", "", fmt.Errorf("failed to set due: %w", err)
+		}
+	}
+	for _, tag := range t.Tags {
+		if err := tags.Set(tag, true); err != nil {
+			return "", "", fmt.Errorf("failed to set tag: %w", err)
+		}
+	}
+	msg, err := editedAt(doc, id, ts, "add task %s %q", id, t.Title)
+	return id, msg, err
+}
+
+// Rename changes the title with the smallest splice that produces the new title, so that concurrent edits to other
+// parts of the title are kept.
+func Rename(doc *automerge.Doc, id, title string) (string, error) {
+	if title == "" {
+		return "", ErrTitleRequired
+	}
+	m, err := taskMap(doc, id)
+	if err != nil {
+		return "", err
+	}
+	v, err := m.Get("title")
+	if err != nil {
+		return "", fmt.Errorf("failed to get title: %w", err)
+	} else if v.Kind() != automerge.KindText {
+		if err := m.Set("title", automerge.NewText(title)); err != nil {
+			return "", fmt.Errorf("failed to set title: %w", err)
+		}
+		return edited(doc, id, "rename task %s to %q", id, title)
+	}
+	if changed, err := codec.UpdateText(v.Text(), title); err != nil {
+		return "", fmt.Errorf("failed to update title: %w", err)
+	} else if !changed {
+		return "", nil
+	}
+	return edited(doc, id, "rename task %s to %q", id, title)
+}
+
+// Complete marks the task as done.
+func Complete(doc *automerge.Doc, id string) (string, error) {
+	m, err := taskMap(doc, id)
+	if err != nil {
+		return "", err
+	}
+	if err := m.Set("status", StatusDone); err != nil {
+		return "", fmt.Errorf("failed to set status: %w", err)
+	}
+	ts := Clock.Now()
+	if err := m.Set("completed_at", ts.Time()); err != nil {
+		return "", fmt.Errorf("failed to set completed at: %w", err)
+	}
+	return editedAt(doc, id, ts, "complete task %s", id)
+}
+
+// Reopen marks the task as open again.
+func Reopen(doc *automerge.Doc, id string) (string, error) {
+	m, err := taskMap(doc, id)
+	if err != nil {
+		return "", err
+	}
+	if err := m.Set("status", StatusOpen); err != nil {
+		return "", fmt.Errorf("failed to set status: %w", err)
+	}
+	if v, _ := m.Get("completed_at"); v != nil && !v.IsVoid() {
+		if err := m.Delete("completed_at"); err != nil {
+			return "", fmt.Errorf("failed to clear completed at: %w", err)
+		}
+	}
+	return edited(doc, id, "reopen task %s", id)
+}
+
+// Assign sets the assignee of the task, or clears it if empty.
+func Assign(doc *automerge.Doc, id, assignee string) (string, error) {
+	m, err := taskMap(doc, id)
+	if err != nil {
+		return "", err
+	}
+	if assignee == "" {
+		err = m.Delete("assignee")
+	} else {
+		err = m.Set("assignee", assignee)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to set assignee: %w", err)
+	}
+	return edited(doc, id, "assign task %s to %q", id, assignee)
+}
+
+// SetDue sets the due date of the task, or clears it if nil.
+func SetDue(doc *automerge.Doc, id string, due *time.Time) (string, error) {
+	m, err := taskMap(doc, id)
+	if err != nil {
+		return "", err
+	}
+	if due == nil {
+		err = m.Delete("due")
+	} else {
+		err = m.Set("due", *due)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to set due: %w", err)
+	}
+	if due == nil {
+		return edited(doc, id, "clear due date of task %s", id)
+	}
+	return edited(doc, id, "set due date of task %s to %s", id, due.Format(time.DateOnly))
+}
+
+// Tag adds the tag to the task.
+func Tag(doc *automerge.Doc, id, tag string) (string, error) {
+	if _, err := taskMap(doc, id); err != nil {
+		return "", err
+	}
+	if err := doc.Path(tasksKey, id, "tags", tag).Set(true); err != nil {
+		return "", fmt.Errorf("failed to set tag: %w", err)
+	}
+	return edited(doc, id, "tag task %s with %q", id, tag)
+}
+
+// Untag removes the tag from the task.
+func Untag(doc *automerge.Doc, id, tag string) (string, error) {
+	if _, err := taskMap(doc, id); err != nil {
+		return "", err
+	}
+	if err := doc.Path(tasksKey, id, "tags", tag).Delete(); err != nil {
+		return "", fmt.Errorf("failed to delete tag: %w", err)
+	}
+	return edited(doc, id, "untag %q from task %s", tag, id)
+}
+
+// Move places the task at the index of the list, as returned by an unfiltered Query. An index past the end moves it
+// to the end.
+func Move(doc *automerge.Doc, id string, index int) (string, error) {
+	m, err := taskMap(doc, id)
+	if err != nil {
+		return "", err
+	}
+	tasks, err := Query(doc, Filter{})
+	if err != nil {
+		return "", err
+	}
+	tasks = slices.DeleteFunc(tasks, func(t Task) bool {
+		return t.ID == id
+	})
+	index = max(0, min(index, len(tasks)))
+	before, after := "", ""
+	if index > 0 {
+		before = tasks[index-1].Order
+	}
+	if index < len(tasks) {
+		after = tasks[index].Order
+	}
+	if err := m.Set("order", orderBetween(before, after)); err != nil {
+		return "", fmt.Errorf("failed to set order: %w", err)
+	}
+	return edited(doc, id, "move task %s to position %d", id, index)
+}
+
+// Delete removes the task.
+func Delete(doc *automerge.Doc, id string) (string, error) {
+	if _, err := taskMap(doc, id); err != nil {
+		return "", err
+	}
+	if err := doc.Path(tasksKey, id).Delete(); err != nil {
+		return "", fmt.Errorf("failed to delete task: %w", err)
+	}
+	return edited(doc, id, "delete task %s", id)
+}
+
+// Filter selects tasks in Query, zero fields match everything.
+type Filter struct {
+	Status    string
+	Assignee  string
+	Tag       string
+	DueBefore *time.Time
+}
+
+func (f Filter) matches(t Task) bool {
+	if f.Status != "" && t.Status != f.Status {
+		return false
+	}
+	if f.Assignee != "" && t.Assignee != f.Assignee {
+		return false
+	}
+	if f.Tag != "" && !slices.Contains(t.Tags, f.Tag) {
+		return false
+	}
+	if f.DueBefore != nil && (t.Due == nil || !t.Due.Before(*f.DueBefore)) {
+		return false
+	}
+	return true
+}
+
+// Get returns a single task.
+func Get(doc *automerge.Doc, id string) (Task, error) {
+	m, err := taskMap(doc, id)
+	if err != nil {
+		return Task{}, err
+	}
+	return readTask(id, m)
+}
+
+// Query returns the matching tasks in list order.
+func Query(doc *automerge.Doc, filter Filter) ([]Task, error) {
+	out := make([]Task, 0)
+	v, err := doc.Path(tasksKey).Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tasks: %w", err)
+	} else if v.Kind() != automerge.KindMap {
+		return out, nil
+	}
+	values, err := v.Map().Values()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tasks: %w", err)
+	}
+	for id, tv := range values {
+		if tv.Kind() != automerge.KindMap {
+			continue
+		}
+		t, err := readTask(id, tv.Map())
+		if err != nil {
+			return nil, err
+		}
+		if filter.matches(t) {
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Order != out[j].Order {
+			return out[i].Order < out[j].Order
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+func readTask(id string, m *automerge.Map) (Task, error) {
+	values, err := m.Values()
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to read task %s: %w", id, err)
+	}
+	t := Task{ID: id, Status: StatusOpen}
+	for key, v := range values {
+		switch {
+		case key == "title" && v.Kind() == automerge.KindText:
+			if t.Title, err = v.Text().Get(); err != nil {
+				return Task{}, fmt.Errorf("failed to read title of %s: %w", id, err)
+			}
+		case key == descriptionKey && v.Kind() == automerge.KindText:
+			if t.Description, err = v.Text().Get(); err != nil {
+				return Task{}, fmt.Errorf("failed to read description of %s: %w", id, err)
+			}
+		case key == "status" && v.Kind() == automerge.KindStr:
+			t.Status = v.Str()
+		case key == "assignee" && v.Kind() == automerge.KindStr:
+			t.Assignee = v.Str()
+		case key == "due" && v.Kind() == automerge.KindTime:
+			due := v.Time()
+			t.Due = &due
+		case key == "order" && v.Kind() == automerge.KindStr:
+			t.Order = v.Str()
+		case key == updatedAtKey && v.Kind() == automerge.KindStr:
+			if t.UpdatedAt, err = hlc.Parse(v.Str()); err != nil {
+				return Task{}, fmt.Errorf("failed to read updated at of %s: %w", id, err)
+			}
+		case key == "created_at" && v.Kind() == automerge.KindTime:
+			t.CreatedAt = v.Time()
+		case key == "completed_at" && v.Kind() == automerge.KindTime:
+			completed := v.Time()
+			t.CompletedAt = &completed
+		case key == "tags" && v.Kind() == automerge.KindMap:
+			if t.Tags, err = v.Map().Keys(); err != nil {
+				return Task{}, fmt.Errorf("failed to read tags of %s: %w", id, err)
+			}
+			sort.Strings(t.Tags)
+		}
+	}
+	// a completion that lost to a concurrent reopen leaves its time behind
+	if t.Status != StatusDone {
+		t.CompletedAt = nil
+	}
+	return t, nil
+}
@@ -0,0 +1,56 @@
+package todo
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/undo"
+)
+
+// NewHistory returns an undo manager for todo lists. It leaves updated_at alone, since restoring an old timestamp
+// would move the task's clock backwards, and stamps every task that an undo or redo changes with the clock instead.
+func NewHistory() *undo.Manager {
+	m := undo.New()
+	m.Skip = func(path []interface{}) bool {
+		return len(path) == 3 && path[0] == tasksKey && path[2] == updatedAtKey
+	}
+	return m
+}
+
+// Undo reverts the most recent local edit recorded by the manager, leaving whatever other peers changed since in
+// place. It returns false if there was nothing left to undo.
+func Undo(doc *automerge.Doc, m *undo.Manager) (bool, error) {
+	return m.Undo(doc, func(msg string, paths [][]interface{}) error {
+		return commitReverted(doc, msg, paths)
+	})
+}
+
+// Redo reverts the most recent Undo.
+func Redo(doc *automerge.Doc, m *undo.Manager) (bool, error) {
+	return m.Redo(doc, func(msg string, paths [][]interface{}) error {
+		return commitReverted(doc, msg, paths)
+	})
+}
+
+// commitReverted stamps the tasks that still exist among the reverted paths and commits.
+func commitReverted(doc *automerge.Doc, msg string, paths [][]interface{}) error {
+	ts := Clock.Now()
+	ids := make([]string, 0)
+	for _, p := range paths {
+		if len(p) < 2 || p[0] != tasksKey {
+			continue
+		} else if id, ok := p[1].(string); ok && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		if m, err := taskMap(doc, id); err == nil {
+			if err := m.Set(updatedAtKey, ts.String()); err != nil {
+				return fmt.Errorf("failed to set updated at: %w", err)
+			}
+		}
+	}
+	return commitAt(doc, ts, msg)
+}
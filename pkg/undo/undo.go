@@ -0,0 +1,268 @@
+// Package undo undoes and redoes local edits to a document.
+//
+// A Manager records each local edit as the heads before and after it. Undoing an edit diffs the document between those
+// heads and writes the old values back in a new change, so the history only ever grows and the undo syncs like any
+// other edit. Values that another peer has changed since the edit are left alone: the undo only reverts what is still
+// as the edit left it. Text is the exception, the edit's splice is followed through later edits with the same approach
+// as richtext cursors and reverted in place as long as the text it inserted is intact.
+//
+// Edits recorded in quick succession with nothing merged in between are grouped into one step, so that undo reverts a
+// burst of typing rather than a single character. Steps refer to changes by hash, so they stay valid as remote changes
+// are merged.
+package undo
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/automerge/automerge-go"
+
+	"github.com/astromechza/automerge-experiments/pkg/changehash"
+	"github.com/astromechza/automerge-experiments/pkg/docdiff"
+	"github.com/astromechza/automerge-experiments/pkg/richtext"
+)
+
+// DefaultWindow is how soon after the previous edit an edit must come to be grouped with it.
+const DefaultWindow = time.Second
+
+// DefaultLimit is how many steps are kept before the oldest are forgotten.
+const DefaultLimit = 100
+
+// step is a range of local edits, from the heads before the first to the heads after the last.
+type step struct {
+	before, after []automerge.ChangeHash
+	at            time.Time
+}
+
+// Manager holds the undo and redo stacks of one document. It is safe for concurrent use, but the caller must make sure
+// the document is not edited during Record, Undo and Redo.
+type Manager struct {
+	lock sync.Mutex
+	undo []step
+	redo []step
+	// Window groups an edit with the previous one if it comes within it, zero disables grouping
+	Window time.Duration
+	Limit  int
+	// Now reads the clock for grouping, it is replaced in tests
+	Now func() time.Time
+	// Skip, if set, leaves the paths it returns true for as they are, for values such as timestamps that the caller
+	// maintains itself
+	Skip func(path []interface{}) bool
+}
+
+func New() *Manager {
+	return &Manager{Window: DefaultWindow, Limit: DefaultLimit, Now: time.Now}
+}
+
+// Record adds a local edit that moved the doc from the before heads to its current heads. Recording an edit clears the
+// redo stack, as in any editor.
+func (m *Manager) Record(doc *automerge.Doc, before []automerge.ChangeHash) {
+	after := doc.Heads()
+	if slices.Equal(before, after) {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := m.Now()
+	m.redo = nil
+	// only extend the last step if nothing was merged since it, otherwise its diff would include the remote changes
+	if n := len(m.undo); n > 0 && slices.Equal(m.undo[n-1].after, before) && now.Sub(m.undo[n-1].at) < m.Window {
+		m.undo[n-1].after, m.undo[n-1].at = after, now
+		return
+	}
+	m.undo = append(m.undo, step{before: before, after: after, at: now})
+	if m.Limit > 0 && len(m.undo) > m.Limit {
+		m.undo = slices.Delete(m.undo, 0, len(m.undo)-m.Limit)
+	}
+}
+
+// CanUndo returns true if there is an edit to undo.
+func (m *Manager) CanUndo() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.undo) > 0
+}
+
+// CanRedo returns true if there is an undo to redo.
+func (m *Manager) CanRedo() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.redo) > 0
+}
+
+// Commit commits the reverted values with the message. It is given the paths that were reverted, so that it can
+// update the values the manager skips.
+type Commit func(msg string, paths [][]interface{}) error
+
+// Undo reverts the most recent step that still has something to revert, and commits the result with the commit
+// function. Steps whose values have all been overwritten by other peers since are dropped. It returns false if there
+// was nothing to undo.
+func (m *Manager) Undo(doc *automerge.Doc, commit Commit) (bool, error) {
+	return m.revert(doc, &m.undo, &m.redo, "undo", commit)
+}
+
+// Redo reverts the most recent undo, as long as no edit was recorded since.
+func (m *Manager) Redo(doc *automerge.Doc, commit Commit) (bool, error) {
+	return m.revert(doc, &m.redo, &m.undo, "redo", commit)
+}
+
+// revert pops steps from one stack until one changes the doc, and pushes the reverting step onto the other.
+func (m *Manager) revert(doc *automerge.Doc, from, to *[]step, verb string, commit Commit) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for len(*from) > 0 {
+		s := (*from)[len(*from)-1]
+		*from = (*from)[:len(*from)-1]
+		before := doc.Heads()
+		paths, err := apply(doc, s, m.Skip)
+		if err != nil {
+			return false, err
+		} else if len(paths) == 0 {
+			continue
+		}
+		keys := make([]string, len(paths))
+		for i, p := range paths {
+			keys[i] = docdiff.PathString(p)
+		}
+		if err := commit(fmt.Sprintf("%s changes to %s", verb, strings.Join(keys, ", ")), paths); err != nil {
+			return false, err
+		}
+		*to = append(*to, step{before: before, after: doc.Heads(), at: m.Now()})
+		return true, nil
+	}
+	return false, nil
+}
+
+// apply writes the values from before the step back where they are still as the step left them, and returns the paths
+// it changed, ordered by path.
+func apply(doc *automerge.Doc, s step, skip func(path []interface{}) bool) ([][]interface{}, error) {
+	before, err := fork(doc, s.before)
+	if err != nil {
+		return nil, err
+	}
+	after, err := fork(doc, s.after)
+	if err != nil {
+		return nil, err
+	}
+	patches, err := docdiff.Diff(before, after)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	changed := make([][]interface{}, 0)
+	for _, p := range patches {
+		path, err := docdiff.Unit(before, after, p.Path)
+		if err != nil {
+			return nil, err
+		}
+		key := docdiff.PathString(path)
+		if seen[key] || (skip != nil && skip(path)) {
+			continue
+		}
+		seen[key] = true
+		if ok, err := revertPath(doc, before, after, s.after, path); err != nil {
+			return nil, fmt.Errorf("failed to revert %s: %w", key, err)
+		} else if ok {
+			changed = append(changed, path)
+		}
+	}
+	slices.SortFunc(changed, func(a, b []interface{}) int {
+		return strings.Compare(docdiff.PathString(a), docdiff.PathString(b))
+	})
+	return changed, nil
+}
+
+// fork checks out the doc at the heads, where no heads is the empty doc rather than the current one.
+func fork(doc *automerge.Doc, heads []automerge.ChangeHash) (*automerge.Doc, error) {
+	if len(heads) == 0 {
+		return automerge.New(), nil
+	}
+	f, err := doc.Fork(heads...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to checkout %v: %w", heads, err)
+	}
+	return f, nil
+}
+
+// revertPath restores the value at the path from before, if the doc still has the value from after.
+func revertPath(doc, before, after *automerge.Doc, afterHeads []automerge.ChangeHash, path []interface{}) (bool, error) {
+	bv, err := before.Path(path...).Get()
+	if err != nil {
+		return false, err
+	}
+	av, err := after.Path(path...).Get()
+	if err != nil {
+		return false, err
+	}
+	cv, err := doc.Path(path...).Get()
+	if err != nil {
+		return false, err
+	}
+	if bv.Kind() == automerge.KindText && av.Kind() == automerge.KindText && cv.Kind() == automerge.KindText {
+		return revertText(doc, bv.Text(), av.Text(), cv.Text(), afterHeads, path)
+	}
+	a, err := docdiff.Materialize(av)
+	if err != nil {
+		return false, err
+	}
+	c, err := docdiff.Materialize(cv)
+	if err != nil {
+		return false, err
+	}
+	if !reflect.DeepEqual(a, c) {
+		return false, nil
+	}
+	return true, docdiff.Restore(doc, path, bv, cv)
+}
+
+// revertText follows the region the edit replaced into the current text, and puts the old text back if the region
+// is unchanged.
+func revertText(doc *automerge.Doc, before, after, current *automerge.Text, afterHeads []automerge.ChangeHash, path []interface{}) (bool, error) {
+	b, err := before.Get()
+	if err != nil {
+		return false, err
+	}
+	a, err := after.Get()
+	if err != nil {
+		return false, err
+	}
+	br, ar := []rune(b), []rune(a)
+	prefix := 0
+	for prefix < len(br) && prefix < len(ar) && br[prefix] == ar[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(br)-prefix && suffix < len(ar)-prefix && br[len(br)-1-suffix] == ar[len(ar)-1-suffix] {
+		suffix++
+	}
+
+	r, err := richtext.NewResolver(doc, path...)
+	if err != nil {
+		return false, err
+	}
+	heads := changehash.Encode(afterHeads)
+	start, err := r.Resolve(richtext.Cursor{Heads: heads, Pos: prefix})
+	if err != nil {
+		return false, err
+	}
+	end, err := r.Resolve(richtext.Cursor{Heads: heads, Pos: len(ar) - suffix})
+	if err != nil {
+		return false, err
+	}
+	c, err := current.Get()
+	if err != nil {
+		return false, err
+	}
+	cr := []rune(c)
+	if end < start || string(cr[start:end]) != string(ar[prefix:len(ar)-suffix]) {
+		return false, nil
+	}
+	if err := current.Splice(start, end-start, string(br[prefix:len(br)-suffix])); err != nil {
+		return false, fmt.Errorf("failed to splice text: %w", err)
+	}
+	return true, nil
+}
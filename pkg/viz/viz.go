@@ -14,6 +14,8 @@ import (
 	"github.com/automerge/automerge-go"
 	"github.com/goccy/go-graphviz"
 	"github.com/goccy/go-graphviz/cgraph"
+
+	"github.com/astromechza/automerge-experiments/pkg/identity"
 )
 
 func RenderDocToSvg(doc *automerge.Doc, nodePath []interface{}, outputPath string) error {
@@ -29,6 +31,7 @@ func RenderDocToSvg(doc *automerge.Doc, nodePath []interface{}, outputPath strin
 		return fmt.Errorf("failed to generate changes: %w", err)
 	}
 
+	names := identity.Names(doc)
 	nodeMap := make(map[string]*cgraph.Node)
 	var edgeCounter uint64
 	for _, change := range changes {
@@ -50,7 +53,7 @@ func RenderDocToSvg(doc *automerge.Doc, nodePath []interface{}, outputPath strin
 		if err != nil {
 			return fmt.Errorf("failed to create node: %w", err)
 		}
-		n.SetLabel(fmt.Sprintf("%s %s@%d %s", change.Hash().String()[:8], change.ActorID(), change.ActorSeq(), string(encoded)))
+		n.SetLabel(fmt.Sprintf("%s %s@%d %s", change.Hash().String()[:8], identity.Label(names, change.ActorID()), change.ActorSeq(), string(encoded)))
 		nodeMap[n.Name()] = n
 
 		for _, hash := range change.Dependencies() {